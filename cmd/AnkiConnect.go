@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	ankierrors "github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// actions of the AnkiConnect api, which are not covered by the ankiconnect package
+const (
+	ActionCanAddNotes = "canAddNotes"
+	ActionAddNotes = "addNotes"
+)
+
+// the AnkiConnect operations NoteUploader depends on.
+// AnkiClient implements it for a running Anki, tests substitute a fake.
+type AnkiApi interface {
+	Ping() *ankierrors.RestErr
+	GetDecks() (*[]string, *ankierrors.RestErr)
+	CreateDeck(name string) *ankierrors.RestErr
+	AddNote(note ankiconnect.Note) *ankierrors.RestErr
+	// reports for each note whether Anki would accept it, i.e. whether it is no duplicate
+	CanAddNotes(notes []ankiconnect.Note) ([]bool, error)
+	// adds all notes in a single request and reports for each note whether it was added
+	AddNotes(notes []ankiconnect.Note) ([]bool, error)
+}
+
+// names of the decks known to exist in Anki, 
+// which is kept up to date by adding created decks instead of requesting all decks again.
+type DeckSet map[string]bool
+
+// returns the set of `decks` and their parent decks.
+func NewDeckSet(decks ...string) DeckSet {
+	set := make(DeckSet, len(decks))
+	for _, deck := range decks {
+		set.Add(deck)
+	}
+	return set
+}
+
+// adds `deck` and its parent decks, which Anki creates implicitly along with it, 
+// e.g. Go::net::http adds Go, Go::net and Go::net::http.
+func (s DeckSet) Add(deck string) {
+	for i := 0; i < len(deck); i++ {
+		if strings.HasPrefix(deck[i:], ankiDeckSep) {
+			s[deck[:i]] = true
+		}
+	}
+	s[deck] = true
+}
+
+func (s DeckSet) Contains(deck string) bool {
+	return s[deck]
+}
+
+// implements AnkiApi using the ankiconnect package
+type AnkiClient struct {
+	*ankiconnect.Client
+	ctx context.Context // cancels the requests of CanAddNotes and AddNotes, nil never does
+	http *http.Client // sends the requests of CanAddNotes and AddNotes, nil uses a client with the default timeout
+}
+
+// returns an AnkiClient for `client`, whose own requests are cancelled with `ctx` and time out after `timeout`.
+func NewAnkiClient(ctx context.Context, client *ankiconnect.Client, timeout time.Duration) AnkiClient {
+	return AnkiClient{Client: client, ctx: ctx, http: &http.Client{Timeout: timeout}}
+}
+
+// returns the context of the requests of `c`.
+func (c AnkiClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// returns the HTTP client of the requests of `c`.
+func (c AnkiClient) httpClient() *http.Client {
+	if c.http == nil {
+		return &http.Client{Timeout: defaultHttpTimeout}
+	}
+	return c.http
+}
+
+func (c AnkiClient) GetDecks() (*[]string, *ankierrors.RestErr) {
+	return c.Decks.GetAll()
+}
+
+func (c AnkiClient) CreateDeck(name string) *ankierrors.RestErr {
+	return c.Decks.Create(name)
+}
+
+func (c AnkiClient) AddNote(note ankiconnect.Note) *ankierrors.RestErr {
+	return c.Notes.Add(note)
+}
+
+func (c AnkiClient) CanAddNotes(notes []ankiconnect.Note) ([]bool, error) {
+	if len(notes) == 0 {
+		return []bool{}, nil
+	}
+	ok, err := AnkiInvoke[[]bool](c.context(), c.httpClient(), c.Client, ActionCanAddNotes, map[string]any{"notes": notes})
+	if err != nil {
+		return nil, err
+	}
+	if len(ok) != len(notes) {
+		return nil, fmt.Errorf("CanAddNotes::expected %d results, got %d", len(notes), len(ok))
+	}
+	return ok, nil
+}
+
+func (c AnkiClient) AddNotes(notes []ankiconnect.Note) ([]bool, error) {
+	added := make([]bool, len(notes))
+	if len(notes) == 0 {
+		return added, nil
+	}
+	ids, err := AnkiInvoke[[]*int64](c.context(), c.httpClient(), c.Client, ActionAddNotes, map[string]any{"notes": notes})
+	if err != nil {
+		return added, err
+	}
+	if len(ids) != len(notes) {
+		return added, fmt.Errorf("AddNotes::expected %d results, got %d", len(notes), len(ids))
+	}
+	for i, id := range ids {
+		added[i] = id != nil
+	}
+	return added, nil
+}
+
+// invokes `action` with `params` on the AnkiConnect api `client` points to and decodes its result.
+// The request is sent by `httpClient` and cancelled with `ctx`, responses other than 200 are rejected.
+func AnkiInvoke[R any](ctx context.Context, httpClient *http.Client, client *ankiconnect.Client, action string, params any) (R, error) {
+	var res struct {
+		Result R       `json:"result"`
+		Error  *string `json:"error"`
+	}
+	body, err := json.Marshal(ankiconnect.RequestPayload[any]{
+		Action: action,
+		Version: client.Version,
+		Params: &params,
+	})
+	if err != nil {
+		return res.Result, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.Url, bytes.NewReader(body))
+	if err != nil {
+		return res.Result, fmt.Errorf("AnkiInvoke::%s: %w", action, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return res.Result, fmt.Errorf("AnkiInvoke::%s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res.Result, fmt.Errorf("AnkiInvoke::%s: unexpected response: %s", action, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res.Result, fmt.Errorf("AnkiInvoke::%s: %w", action, err)
+	}
+	if res.Error != nil {
+		return res.Result, fmt.Errorf("AnkiInvoke::%s: %w", action, errors.New(*res.Error))
+	}
+	return res.Result, nil
+}
+
+// returns the notes Anki would accept, i.e. all notes which are no duplicates of existing notes,
+// and the number of dropped notes.
+func FilterNewNotes(client AnkiApi, notes []ankiconnect.Note) ([]ankiconnect.Note, int, error) {
+	if len(notes) == 0 {
+		return notes, 0, nil
+	}
+	ok, err := client.CanAddNotes(notes)
+	if err != nil {
+		return notes, 0, err
+	}
+	if len(ok) != len(notes) {
+		return notes, 0, fmt.Errorf("FilterNewNotes::expected %d results, got %d", len(notes), len(ok))
+	}
+	res := make([]ankiconnect.Note, 0, len(notes))
+	for i, note := range notes {
+		if ok[i] {
+			res = append(res, note)
+		}
+	}
+	return res, len(notes) - len(res), nil
+}
+
+// ensures the note model `model` exists in Anki and has all `fields`.
+func CheckModel(client *ankiconnect.Client, model string, fields []string) error {
+	models, restErr := client.Models.GetAll()
+	if restErr != nil {
+		return fmt.Errorf("cannot list note models: %s", restErr.Message)
+	}
+	if !slices.Contains(*models, model) {
+		return fmt.Errorf("note model '%s' doesn't exist in Anki", model)
+	}
+	have, restErr := client.Models.GetFields(model)
+	if restErr != nil {
+		return fmt.Errorf("cannot list fields of note model '%s': %s", model, restErr.Message)
+	}
+	missing := make([]string, 0)
+	for _, field := range fields {
+		if !slices.Contains(*have, field) {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("note model '%s' lacks the fields: %s", model, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// card templates and styling of models created by CreateModel
+const (
+	modelFront = "{{%[1]s}}"
+	modelBack = "{{FrontSide}}\n<hr id=answer>\n{{%[2]s}}\n{{#%[3]s}}<hr>{{%[3]s}}{{/%[3]s}}"
+	// the front field of cloze models holds the cloze deletions
+	clozeFront = "{{cloze:%[1]s}}"
+	clozeBack = "{{cloze:%[1]s}}\n<hr id=answer>\n{{%[2]s}}\n{{#%[3]s}}<hr>{{%[3]s}}{{/%[3]s}}"
+	modelCss = `.card { font-family: arial; font-size: 16px; text-align: left; color: black; background-color: white; }
+pre, code { font-family: monospace; white-space: pre-wrap; }`
+)
+
+// returns the front and back templates of cards of models with the fields `fields`.
+// Cloze models show the front field with its cloze deletions hidden on the front.
+func ModelTemplates(fields FieldMap, cloze bool) (front, back string) {
+	if cloze {
+		return fmt.Sprintf(clozeFront, fields.Front), fmt.Sprintf(clozeBack, fields.Front, fields.Back, fields.Impl)
+	}
+	return fmt.Sprintf(modelFront, fields.Front), fmt.Sprintf(modelBack, fields.Front, fields.Back, fields.Impl)
+}
+
+// creates the note model `model` with the fields of `fields`, unless it already exists. 
+// Cards show the front field on the front and the back and impl fields on the back,
+// `cloze` creates a cloze model, which generates a card per cloze deletion of the front field.
+// Reports whether the model was created.
+func CreateModel(client *ankiconnect.Client, model string, fields FieldMap, cloze bool) (bool, error) {
+	models, restErr := client.Models.GetAll()
+	if restErr != nil {
+		return false, fmt.Errorf("cannot list note models: %s", restErr.Message)
+	}
+	if slices.Contains(*models, model) {
+		return false, nil
+	}
+	front, back := ModelTemplates(fields, cloze)
+	restErr = client.Models.Create(ankiconnect.Model{
+		ModelName: model,
+		InOrderFields: fields.Names(),
+		Css: modelCss,
+		IsCloze: cloze,
+		CardTemplates: []ankiconnect.CardTemplate{{
+			Name: "Card 1",
+			Front: front,
+			Back: back,
+		}},
+	})
+	if restErr != nil {
+		return false, fmt.Errorf("cannot create note model '%s': %s", model, restErr.Message)
+	}
+	return true, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	ankierrors "github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// in-memory AnkiApi. Notes are duplicates, if a note with the same deck and front exists.
+type fakeAnki struct {
+	decks []string
+	notes []ankiconnect.Note
+	batchFails bool // AddNotes fails, so notes are added one by one
+	serverErrors int // number of 500 responses of AddNote before it succeeds
+	duplicates bool // CanAddNotes reports every note as new
+	rejectFront string // AddNote rejects notes with this front with a 400 response
+	addCalls int // calls of AddNote
+	created []string // decks passed to CreateDeck
+	createFails string // CreateDeck fails for this deck with a 500 response
+}
+
+func (f *fakeAnki) Ping() *ankierrors.RestErr {
+	return nil
+}
+
+func (f *fakeAnki) GetDecks() (*[]string, *ankierrors.RestErr) {
+	decks := slices.Clone(f.decks)
+	return &decks, nil
+}
+
+func (f *fakeAnki) CreateDeck(name string) *ankierrors.RestErr {
+	f.created = append(f.created, name)
+	if name == f.createFails {
+		return &ankierrors.RestErr{Message: "collection is not available", StatusCode: http.StatusInternalServerError}
+	}
+	if !slices.Contains(f.decks, name) {
+		f.decks = append(f.decks, name)
+	}
+	return nil
+}
+
+func (f *fakeAnki) duplicate(note ankiconnect.Note) bool {
+	return slices.ContainsFunc(f.notes, func(n ankiconnect.Note) bool {
+		return n.DeckName == note.DeckName && n.Fields[defaultFieldMap.Front] == note.Fields[defaultFieldMap.Front]
+	})
+}
+
+func (f *fakeAnki) AddNote(note ankiconnect.Note) *ankierrors.RestErr {
+	f.addCalls++
+	if f.serverErrors > 0 {
+		f.serverErrors--
+		return &ankierrors.RestErr{Message: "connection refused", StatusCode: http.StatusInternalServerError}
+	}
+	if f.duplicate(note) {
+		return &ankierrors.RestErr{Message: "cannot create note because it is a duplicate", StatusCode: http.StatusBadRequest}
+	}
+	if note.Fields[defaultFieldMap.Front] == f.rejectFront {
+		return &ankierrors.RestErr{Message: "cannot create note because it is empty", StatusCode: http.StatusBadRequest}
+	}
+	f.notes = append(f.notes, note)
+	return nil
+}
+
+func (f *fakeAnki) CanAddNotes(notes []ankiconnect.Note) ([]bool, error) {
+	ok := make([]bool, len(notes))
+	for i, note := range notes {
+		ok[i] = f.duplicates || !f.duplicate(note)
+	}
+	return ok, nil
+}
+
+func (f *fakeAnki) AddNotes(notes []ankiconnect.Note) ([]bool, error) {
+	added := make([]bool, len(notes))
+	if f.batchFails {
+		return added, errors.New("AnkiInvoke::addNotes: connection refused")
+	}
+	for i, note := range notes {
+		if !f.duplicate(note) {
+			f.notes = append(f.notes, note)
+			added[i] = true
+		}
+	}
+	return added, nil
+}
+
+func TestDeckSet(t *testing.T) {
+	decks := NewDeckSet("Default", "Go::net::http")
+	for _, deck := range []string{"Default", "Go", "Go::net", "Go::net::http"} {
+		if !decks.Contains(deck) {
+			t.Errorf("expected '%s' to be known", deck)
+		}
+	}
+	for _, deck := range []string{"Go::net::url", "Go::n", "net"} {
+		if decks.Contains(deck) {
+			t.Errorf("didn't expect '%s' to be known", deck)
+		}
+	}
+	decks.Add("Go::io::fs")
+	if !decks.Contains("Go::io") || !decks.Contains("Go::io::fs") {
+		t.Fatal("expected the added deck and its parents to be known")
+	}
+}
+
+func TestAnkiInvoke(t *testing.T) {
+	release := make(chan struct{})
+	// note models by name, extended by createModel
+	models := map[string][]string{"Golang": defaultFieldMap.Names(), "Basic": {"Front", "Back"}}
+	var created []ankiconnect.Model
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Action string; Params json.RawMessage }
+		json.NewDecoder(r.Body).Decode(&payload)
+		// the ankiconnect client decodes JSON responses only
+		w.Header().Set("Content-Type", "application/json")
+		switch payload.Action {
+		case ActionCanAddNotes:
+			w.Write([]byte(`{"result": [true, false], "error": null}`))
+		case ankiconnect.ActionModelNames:
+			names := make([]string, 0, len(models))
+			for name := range models {
+				names = append(names, name)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"result": names, "error": nil})
+		case ankiconnect.ActionModelFieldNames:
+			var params struct{ ModelName string }
+			json.Unmarshal(payload.Params, &params)
+			fields, ok := models[params.ModelName]
+			if !ok {
+				w.Write([]byte(`{"result": null, "error": "model was not found"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"result": fields, "error": nil})
+		case ankiconnect.ActionCreateModel:
+			var model ankiconnect.Model
+			json.Unmarshal(payload.Params, &model)
+			created = append(created, model)
+			models[model.ModelName] = model.InOrderFields
+			w.Write([]byte(`{"result": {}, "error": null}`))
+		case "hang":
+			<-release
+		default:
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	// hanging handlers are released before the server is closed
+	defer close(release)
+	client := ankiconnect.NewClient()
+	client.SetURL(server.URL)
+
+	ok, err := AnkiInvoke[[]bool](context.Background(), server.Client(), client, ActionCanAddNotes, nil)
+	if err != nil || !slices.Equal(ok, []bool{true, false}) {
+		t.Fatalf("expected the decoded result, got %v %v", ok, err)
+	}
+	if _, err := AnkiInvoke[[]bool](context.Background(), server.Client(), client, "other", nil); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the 403 response to be rejected, got %v", err)
+	}
+	// a hanging AnkiConnect times out and is cancelled
+	if _, err := AnkiInvoke[[]bool](context.Background(), &http.Client{Timeout: 20 * time.Millisecond}, client, "hang", nil); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	if _, err := AnkiInvoke[[]bool](ctx, server.Client(), client, "hang", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+
+	// note models
+	if err := CheckModel(client, "Golang", defaultFieldMap.Names()); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckModel(client, "Missing", defaultFieldMap.Names()); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Fatalf("expected the missing model to be reported, got %v", err)
+	}
+	if err := CheckModel(client, "Basic", defaultFieldMap.Names()); err == nil || !strings.Contains(err.Error(), "lacks the fields: Identifier, Declaration, Implementation") {
+		t.Fatalf("expected the mismatched fields to be reported, got %v", err)
+	}
+	if ok, err := CreateModel(client, "Golang", defaultFieldMap, false); ok || err != nil || len(created) != 0 {
+		t.Fatalf("expected the existing model to be kept, got %v %v %v", ok, err, created)
+	}
+	if ok, err := CreateModel(client, "Golang Cloze", defaultFieldMap, true); !ok || err != nil {
+		t.Fatalf("expected the model to be created, got %v %v", ok, err)
+	}
+	if len(created) != 1 || !created[0].IsCloze || !slices.Equal(created[0].InOrderFields, defaultFieldMap.Names()) {
+		t.Fatalf("expected a cloze model with the fields of the field map, got %+v", created)
+	}
+	if err := CheckModel(client, "Golang Cloze", defaultFieldMap.Names()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	"golang.org/x/net/html"
+	_ "modernc.org/sqlite"
+
+	HTMLTrees "gostdlibintoankicards/pkg"
+)
+
+// collects the notes of all tasks and writes them into the Anki package `cfg.OutputFile` once `in` is closed.
+// In cloze mode notes without cloze deletions on their front, which would have no cards, are rejected.
+// Returns the summary of the written notes.
+func ApkgWriter(ctx context.Context, cfg Config, in <-chan Task) (summary Summary) {
+	notes := make([]ankiconnect.Note, 0)
+	for task := range in {
+		if ctx.Err() != nil {
+			return
+		}
+		summary.Decks++
+		if task.err != nil {
+			slog.Warn("skipped failed task", "deck", task.deck, "url", task.url, "err", task.err)
+			summary.Fail(task)
+			continue
+		}
+		for _, note := range task.notes {
+			if cfg.Mode == modeCloze && len(clozeOrds(note.Fields[cfg.FieldMap.Front])) == 0 {
+				slog.Warn("rejected note without cloze deletions", "deck", task.deck, "front", note.Fields[cfg.FieldMap.Front])
+				summary.Rejected++
+				continue
+			}
+			notes = append(notes, note)
+		}
+		slog.Info("collected notes", "deck", task.deck, "notes", len(task.notes))
+	}
+	if err := WriteApkg(cfg.OutputFile, notes, cfg.FieldMap, cfg.Mode == modeCloze); err != nil {
+		slog.Error("writing the package failed", "file", cfg.OutputFile, "err", err)
+		summary.Errors++
+		return
+	}
+	summary.Added = len(notes)
+	slog.Info("wrote notes", "file", cfg.OutputFile, "notes", len(notes))
+	return
+}
+
+// schema of an Anki collection (version 11), as expected inside an Anki package
+const apkgSchema = `
+CREATE TABLE col (
+	id integer primary key, crt integer not null, mod integer not null, scm integer not null,
+	ver integer not null, dty integer not null, usn integer not null, ls integer not null,
+	conf text not null, models text not null, decks text not null, dconf text not null, tags text not null
+);
+CREATE TABLE notes (
+	id integer primary key, guid text not null, mid integer not null, mod integer not null,
+	usn integer not null, tags text not null, flds text not null, sfld integer not null,
+	csum integer not null, flags integer not null, data text not null
+);
+CREATE TABLE cards (
+	id integer primary key, nid integer not null, did integer not null, ord integer not null,
+	mod integer not null, usn integer not null, type integer not null, queue integer not null,
+	due integer not null, ivl integer not null, factor integer not null, reps integer not null,
+	lapses integer not null, left integer not null, odue integer not null, odid integer not null,
+	flags integer not null, data text not null
+);
+CREATE TABLE revlog (
+	id integer primary key, cid integer not null, usn integer not null, ease integer not null,
+	ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null,
+	type integer not null
+);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
+
+// collection settings and the default deck options of a new Anki collection
+const (
+	apkgConf = `{"activeDecks":[1],"curDeck":1,"newSpread":0,"collapseTime":1200,"timeLim":0,"estTimes":true,"dueCounts":true,"curModel":null,"nextPos":1,"sortType":"noteFld","sortBackwards":false,"addToCur":true}`
+	apkgDconf = `{"1":{"autoplay":true,"id":1,"lapse":{"delays":[10],"leechAction":0,"leechFails":8,"minInt":1,"mult":0},"maxTaken":60,"mod":0,"name":"Default","new":{"bury":true,"delays":[1,10],"initialFactor":2500,"ints":[1,4,7],"order":1,"perDay":20,"separate":true},"replayq":true,"rev":{"bury":true,"ease4":1.3,"fuzz":0.05,"ivlFct":1,"maxIvl":36500,"minSpace":1,"perDay":100},"timer":0,"usn":0}}`
+)
+
+// returns a stable positive id for `name`, so repeated imports map onto the same decks and models.
+func apkgId(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64() >> 12)
+}
+
+// writes `notes` into the Anki package `fp`. Models are derived from the notes' model names using `fields`,
+// decks from their deck names, nested decks keep their `::` hierarchy. `cloze` writes cloze models, whose notes get a card per cloze deletion on their front.
+func WriteApkg(fp string, notes []ankiconnect.Note, fields FieldMap, cloze bool) error {
+	dir, err := os.MkdirTemp("", "apkg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "collection.anki2")
+	if err := writeCollection(dbPath, notes, fields, cloze); err != nil {
+		return fmt.Errorf("WriteApkg::collection: %w", err)
+	}
+
+	file, err := os.Create(fp)
+	if err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	db, err := os.Open(dbPath)
+	if err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	defer db.Close()
+	w, err := archive.Create("collection.anki2")
+	if err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	if _, err := io.Copy(w, db); err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	w, err = archive.Create("media")
+	if err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	if _, err := io.WriteString(w, "{}"); err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("WriteApkg::%w", err)
+	}
+	return file.Close()
+}
+
+func writeCollection(fp string, notes []ankiconnect.Note, fields FieldMap, cloze bool) error {
+	db, err := sql.Open("sqlite", fp)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(apkgSchema); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	models := make(map[string]any)
+	decks := map[string]any{
+		"1": apkgDeck(1, "Default", now),
+	}
+	for _, note := range notes {
+		mid := apkgId(note.ModelName)
+		models[strconv.FormatInt(mid, 10)] = apkgModel(mid, note.ModelName, fields, cloze, now)
+		did := apkgId(note.DeckName)
+		decks[strconv.FormatInt(did, 10)] = apkgDeck(did, note.DeckName, now)
+	}
+	modelsJson, err := json.Marshal(models)
+	if err != nil {
+		return err
+	}
+	decksJson, err := json.Marshal(decks)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"INSERT INTO col VALUES(1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')",
+		now.Unix(), now.UnixMilli(), now.UnixMilli(), apkgConf, string(modelsJson), string(decksJson), apkgDconf,
+	)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	base := now.UnixMilli()
+	card := int64(0)
+	for i, note := range notes {
+		id := base + int64(i)
+		values := make([]string, 0, 3)
+		for _, name := range fields.Names() {
+			values = append(values, note.Fields[name])
+		}
+		sort := apkgSortField(values[0])
+		sum := sha1.Sum([]byte(sort))
+		csum, _ := strconv.ParseInt(hex.EncodeToString(sum[:4]), 16, 64)
+		// all fields make up the guid, so distinct notes sharing a front don't replace each other on import
+		guid := sha1.Sum([]byte(note.DeckName + "\x1f" + note.ModelName + "\x1f" + strings.Join(values, "\x1f")))
+		_, err := tx.Exec(
+			"INSERT INTO notes VALUES(?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')",
+			id, base64.RawStdEncoding.EncodeToString(guid[:10]), apkgId(note.ModelName), now.Unix(),
+			" " + strings.Join(note.Tags, " ") + " ", strings.Join(values, "\x1f"), sort, csum,
+		)
+		if err != nil {
+			return err
+		}
+		ords := []int{0}
+		if cloze {
+			ords = clozeOrds(values[0])
+		}
+		for _, ord := range ords {
+			_, err = tx.Exec(
+				"INSERT INTO cards VALUES(?, ?, ?, ?, ?, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')",
+				base + card, id, apkgId(note.DeckName), ord, now.Unix(), i,
+			)
+			if err != nil {
+				return err
+			}
+			card++
+		}
+	}
+	return tx.Commit()
+}
+
+var clozePattern = regexp.MustCompile(`{{c(\d+)::`)
+
+// returns the card ordinals of the cloze deletions in `field`, i.e. the distinct cloze numbers minus one in ascending order.
+func clozeOrds(field string) []int {
+	ords := make([]int, 0)
+	for _, match := range clozePattern.FindAllStringSubmatch(field, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 {
+			continue
+		}
+		if !slices.Contains(ords, n - 1) {
+			ords = append(ords, n - 1)
+		}
+	}
+	slices.Sort(ords)
+	return ords
+}
+
+// returns the plain text of the sort field, which Anki uses for sorting and duplicate checks.
+func apkgSortField(field string) string {
+	root, err := html.Parse(strings.NewReader(field))
+	if err != nil {
+		return field
+	}
+	return HTMLTrees.TextContent(root)
+}
+
+func apkgDeck(id int64, name string, now time.Time) map[string]any {
+	return map[string]any{
+		"id": id,
+		"name": name,
+		"desc": "",
+		"mod": now.Unix(),
+		"usn": -1,
+		"conf": 1,
+		"dyn": 0,
+		"collapsed": false,
+		"extendNew": 10,
+		"extendRev": 50,
+		"newToday": []int{0, 0},
+		"revToday": []int{0, 0},
+		"lrnToday": []int{0, 0},
+		"timeToday": []int{0, 0},
+	}
+}
+
+func apkgModel(id int64, name string, fields FieldMap, cloze bool, now time.Time) map[string]any {
+	flds := make([]map[string]any, 0, 3)
+	for i, field := range fields.Names() {
+		flds = append(flds, map[string]any{
+			"name": field,
+			"ord": i,
+			"font": "Arial",
+			"size": 20,
+			"media": []string{},
+			"rtl": false,
+			"sticky": false,
+		})
+	}
+	front, back := ModelTemplates(fields, cloze)
+	type_ := 0
+	if cloze {
+		type_ = 1
+	}
+	return map[string]any{
+		"id": id,
+		"name": name,
+		"type": type_,
+		"mod": now.Unix(),
+		"usn": -1,
+		"sortf": 0,
+		"did": 1,
+		"flds": flds,
+		"tmpls": []map[string]any{{
+			"name": "Card 1",
+			"ord": 0,
+			"qfmt": front,
+			"afmt": back,
+			"bqfmt": "",
+			"bafmt": "",
+			"did": nil,
+		}},
+		"css": modelCss,
+		"latexPre": "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+		"latexPost": "\\end{document}",
+		"req": []any{[]any{0, "any", []int{0}}},
+		"tags": []string{},
+		"vers": []string{},
+	}
+}
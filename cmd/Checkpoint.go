@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// append-only record of (deck, url) pairs, whose notes were uploaded completely.
+// Uses the format of the url file, one pair per line.
+// A nil *Checkpoint records nothing and reports no pair as done.
+type Checkpoint struct {
+	mu sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+// opens the checkpoint file at `fp`, creating it if necessary.
+// Pairs recorded by previous runs are only reported as done if `resume` is set.
+func OpenCheckpoint(fp string, resume bool) (*Checkpoint, error) {
+	c := &Checkpoint{
+		done: make(map[string]bool),
+	}
+	if resume {
+		file, err := os.Open(fp)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read checkpoint file '%s': %w", fp, err)
+		}
+		if err == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var deck, url string
+				if n, _ := fmt.Sscanf(scanner.Text(), "%s %s", &deck, &url); n == 2 {
+					c.done[checkpointKey(deck, url)] = true
+				}
+			}
+			file.Close()
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("cannot read checkpoint file '%s': %w", fp, err)
+			}
+		}
+	}
+	file, err := os.OpenFile(fp, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open checkpoint file '%s': %w", fp, err)
+	}
+	c.file = file
+	return c, nil
+}
+
+func checkpointKey(deck, url string) string {
+	return deck + " " + url
+}
+
+// reports whether the pair was recorded by a previous run.
+func (c *Checkpoint) Done(deck, url string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[checkpointKey(deck, url)]
+}
+
+// appends the pair to the checkpoint file.
+func (c *Checkpoint) Record(deck, url string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := fmt.Fprintln(c.file, checkpointKey(deck, url))
+	return err
+}
+
+func (c *Checkpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.file.Close()
+}
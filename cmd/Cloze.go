@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// returns the function or method declaration `decl`, e.g. `func Clone(b []byte) []byte`, with its receiver, 
+// parameters and results wrapped into Anki cloze deletions, numbered in this order.
+// The declared name is qualified by `pkg` and the receiver type, e.g. `func bytes.Clone({{c1::b []byte}}) {{c2::[]byte}}`.
+// Returns an empty string, if the declaration has nothing to hide.
+func ClozeSignature(decl, pkg string) (string, error) {
+	const prefix = "package p\n"
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", prefix + decl, parser.ParseComments)
+	if err != nil {
+		return "", fmt.Errorf("ClozeSignature::%w", err)
+	}
+	if len(file.Decls) != 1 {
+		return "", fmt.Errorf("ClozeSignature::expected a single declaration, got %d", len(file.Decls))
+	}
+	fn, ok := file.Decls[0].(*ast.FuncDecl)
+	if !ok {
+		return "", fmt.Errorf("ClozeSignature::not a function declaration: %s", decl)
+	}
+	offset := func(pos token.Pos) int {
+		return fset.Position(pos).Offset - len(prefix)
+	}
+
+	// an insertion of `text` at `pos`, cloze deletions are expressed as a pair of insertions
+	type insert struct {
+		pos int
+		text string
+	}
+	inserts := make([]insert, 0)
+	cloze := 0
+	hide := func(start, end token.Pos) {
+		cloze++
+		inserts = append(inserts, insert{offset(start), fmt.Sprintf("{{c%d::", cloze)}, insert{offset(end), "}}"})
+	}
+
+	qualifier := pkg + "."
+	if fn.Recv != nil && len(fn.Recv.List) > 0 {
+		hide(fn.Recv.Opening + 1, fn.Recv.Closing)
+		qualifier += receiverName(fn.Recv.List[0].Type) + "."
+	}
+	inserts = append(inserts, insert{offset(fn.Name.Pos()), qualifier})
+	if params := fn.Type.Params; params.NumFields() > 0 {
+		hide(params.Opening + 1, params.Closing)
+	}
+	if results := fn.Type.Results; results.NumFields() > 0 {
+		hide(results.Pos(), results.End())
+	}
+	if cloze == 0 {
+		return "", nil
+	}
+
+	sort.SliceStable(inserts, func(i, j int) bool {
+		return inserts[i].pos < inserts[j].pos
+	})
+	var sb strings.Builder
+	last := 0
+	for _, ins := range inserts {
+		if ins.text == "}}" {
+			sb.WriteString(clozeText(decl[last:ins.pos]))
+		} else {
+			sb.WriteString(decl[last:ins.pos])
+		}
+		sb.WriteString(ins.text)
+		last = ins.pos
+	}
+	sb.WriteString(decl[last:])
+	return sb.String(), nil
+}
+
+// returns the hidden text `text` of a cloze deletion with its braces separated by spaces, where they would end the deletion early,
+// e.g. `<-chan struct{}` -> `<-chan struct{} `, as Anki closes a deletion at the first `}}`.
+func clozeText(text string) string {
+	for strings.Contains(text, "}}") {
+		text = strings.ReplaceAll(text, "}}", "} }")
+	}
+	if strings.HasSuffix(text, "}") {
+		text += " "
+	}
+	return text
+}
+
+// returns the name of the receiver type `expr`, e.g. `*List[T]` -> List.
+func receiverName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/ericchiang/css"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// inline styles of code blocks, as Anki doesn't know pkg.go.dev's stylesheet
+const (
+	codeStyle = "display: block; font-family: monospace; white-space: pre; overflow-x: auto; padding: 0.5em; background-color: #f6f8fa; border-radius: 4px;"
+	commentStyle = "color: #707070;"
+)
+
+var (
+	preSelector = css.MustParse("pre")
+	commentSelector = css.MustParse("pre span.comment")
+)
+
+// returns `code` as an HTML code block, styled inline if enabled by -inline-style.
+func (s CardSettings) CodeBlock(code string) string {
+	if !s.InlineStyle {
+		return "<pre><code>" + html.EscapeString(code) + "</code></pre>"
+	}
+	return `<pre style="` + codeStyle + `"><code>` + html.EscapeString(code) + "</code></pre>"
+}
+
+// styles the code blocks of the given tree inline. The content of each <pre> is wrapped into a <code> element
+// and comments, which pkg.go.dev colors by their class, get an inline color.
+func InlineCodeStyle(root *html.Node) {
+	for _, span := range commentSelector.Select(root) {
+		setStyle(span, commentStyle)
+	}
+	for _, pre := range preSelector.Select(root) {
+		setStyle(pre, codeStyle)
+		if c := pre.FirstChild; c != nil && c == pre.LastChild && c.Type == html.ElementNode && c.DataAtom == atom.Code {
+			continue
+		}
+		code := &html.Node{
+			Type: html.ElementNode,
+			DataAtom: atom.Code,
+			Data: "code",
+		}
+		for c := pre.FirstChild; c != nil; {
+			next := c.NextSibling
+			pre.RemoveChild(c)
+			code.AppendChild(c)
+			c = next
+		}
+		pre.AppendChild(code)
+	}
+}
+
+// appends `style` to the style attribute of `node`.
+func setStyle(node *html.Node, style string) {
+	i := slices.IndexFunc(node.Attr, func(attr html.Attribute) bool {
+		return attr.Key == "style"
+	})
+	if i < 0 {
+		node.Attr = append(node.Attr, html.Attribute{Key: "style", Val: style})
+		return
+	}
+	node.Attr[i].Val = strings.TrimSuffix(strings.TrimSpace(node.Attr[i].Val), ";") + "; " + style
+}
+
+// returns the text of the code element `node` with its whitespace preserved, apart from leading and trailing newlines.
+func CodeText(node *html.Node) string {
+	var sb strings.Builder
+	var rec func(node *html.Node)
+	rec = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			sb.WriteString(node.Data)
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			rec(c)
+		}
+	}
+	rec(node)
+	return strings.Trim(sb.String(), "\n")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/time/rate"
+)
+
+// settings of the generated cards, passed to the processors by Config and kept by each task, see Task.settings
+type CardSettings struct {
+	Mode string // kind of the generated notes, modeBasic or modeCloze
+	Profile *Profile // selectors matching the layout of the documentation pages
+	FieldMap FieldMap // fields of the note model receiving the front, back and implementation of notes
+	Tags []string // tags added to every note
+	ExportedOnly bool // skip notes of identifiers, which aren't exported
+	InlineStyle bool // style code blocks inline
+	Highlight bool // highlight the Go syntax of declarations, implementations and examples
+	BaseUrl *url.URL // scheme and host links of cards resolve against, nil keeps those of the task url
+	Reverse bool // additionally generate notes asking for the identifier of a documentation block
+	SplitConstBlocks bool // generate a note per constant of a const block
+	SplitVarBlocks bool // generate a note per variable of a var block
+	AddedSince []int // generate only notes of symbols added in this Go version or later, nil generates all
+	NoDoc bool // leave the documentation paragraphs off the backs, showing declarations only
+	PlainFront bool // fill the front field of function, type and method notes with the plain text of their headers
+}
+
+// returns the card settings used without flags.
+func DefaultCardSettings() CardSettings {
+	return CardSettings{
+		Mode: modeBasic,
+		Profile: profiles[defaultProfile],
+		FieldMap: defaultFieldMap,
+		ExportedOnly: true,
+	}
+}
+
+// registers a flag for each card setting of `s` settable by a plain flag, defaulting to the current values of `s`.
+// The profile, base url, version and tags are parsed by main.
+func (s *CardSettings) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.Mode, "mode", s.Mode, "kind of the generated notes: basic (identifier on the front, documentation on the back) or cloze (signatures of functions and methods with hidden receiver, parameters and results)")
+	fs.Var(&s.FieldMap, "field-map", "fields of the -model receiving the front, back and implementation of a note, e.g. front=Front,back=Back,impl=Extra")
+	fs.BoolVar(&s.ExportedOnly, "exported-only", s.ExportedOnly, "skip cards of identifiers, which aren't exported")
+	fs.BoolVar(&s.InlineStyle, "inline-style", s.InlineStyle, "style code blocks inline, so they render as code in any Anki theme")
+	fs.BoolVar(&s.Highlight, "highlight", s.Highlight, "highlight the Go syntax of declarations, implementations and examples by inline styles")
+	fs.BoolVar(&s.PlainFront, "plain-front", s.PlainFront, "fill the front of function, type and method notes with the plain text of their headers instead of HTML, which sorts and searches better in Anki")
+	fs.BoolVar(&s.NoDoc, "no-doc", s.NoDoc, "leave the documentation off the backs of the notes, showing only the declarations of functions, types, methods, variables and constants")
+	fs.BoolVar(&s.SplitConstBlocks, "split-const-blocks", s.SplitConstBlocks, "generate a note per constant of a const block instead of one for the whole block")
+	fs.BoolVar(&s.SplitVarBlocks, "split-var-blocks", s.SplitVarBlocks, "generate a note per variable of a var block instead of one for the whole block")
+	fs.BoolVar(&s.Reverse, "reverse", s.Reverse, "additionally generate reverse notes of functions, types and methods, which ask for the identifier of their documentation")
+}
+
+// tunables of the pipeline, populated from flags by RegisterFlags and passed to the stages explicitly.
+type Config struct {
+	CardSettings // settings of the generated cards, passed on to the tasks
+
+	DownloadWorkers int // number of concurrent HtmlDownloader
+	ProcessWorkers int // number of concurrent HtmlProcessor
+	HttpTimeout time.Duration // timeout of a single HTTP request, including reading the body
+
+	DownloadRetries int // retries of a download answered with 429 or 5xx
+	RetryDelay time.Duration // initial delay between download retries, doubled on each retry
+	UploadRetries int // retries of a note upload, which failed with a server error
+	UploadRetryDelay time.Duration // initial delay between upload retries, doubled on each retry
+
+	Rate float64 // maximum rate of page downloads per second of all download workers together, 0 doesn't limit it
+	Limiter *rate.Limiter // bounds the request rate of all downloads together, nil doesn't limit it, see NewLimiter
+	UserAgent string // User-Agent header of all download requests
+	CACert string // PEM file of root certificates trusted in addition to the system's, e.g. of a proxy intercepting TLS
+	Insecure bool // skip the verification of server certificates
+	ParseOnDownload bool // pass parsed trees instead of sources from HtmlDownloader to HtmlProcessor
+
+	Model string // note model of tasks, whose pair names none
+	Output string // destination of the notes, one of outputAnki, outputApkg, outputTsv and outputJson
+	OutputFile string // file written by the outputs apkg, tsv and json, empty writes notes.<output>
+	SkipEmpty bool // don't create the decks of tasks without notes
+
+	DeckSep string // separator of the deck levels in url files, arguments and DeckPrefix
+	DeckPrefix string // root deck of all tasks, empty keeps the decks of the url file
+	DeckPrefixReplace int // number of leading deck levels replaced by DeckPrefix
+	TaskLimit int // maximum number of created tasks, 0 or less creates all
+	DiscoverClient *http.Client // downloads module pages, whose packages replace the pages' pairs, nil disables -discover
+}
+
+// returns the configuration used without flags.
+func DefaultConfig() Config {
+	return Config{
+		CardSettings: DefaultCardSettings(),
+		DownloadWorkers: defaultDownloadWorkers,
+		ProcessWorkers: defaultProcessWorkers,
+		HttpTimeout: defaultHttpTimeout,
+		DownloadRetries: defaultDownloadRetries,
+		RetryDelay: defaultRetryDelay,
+		UploadRetries: defaultUploadRetries,
+		UploadRetryDelay: defaultUploadRetryDelay,
+		UserAgent: "GoDoc2Anki/" + version + " (+" + repoUrl + ")",
+		Model: defaultModel,
+		Output: outputAnki,
+		DeckSep: ankiDeckSep,
+	}
+}
+
+// registers a flag for each tunable of `c` in `fs`, defaulting to the current values of `c`.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	c.CardSettings.RegisterFlags(fs)
+	fs.IntVar(&c.DownloadWorkers, "download-workers", c.DownloadWorkers, "number of concurrent HTML downloaders")
+	fs.IntVar(&c.ProcessWorkers, "process-workers", c.ProcessWorkers, "number of concurrent HTML processors")
+	fs.DurationVar(&c.HttpTimeout, "http-timeout", c.HttpTimeout, "timeout of a single HTTP request, including reading the body")
+	fs.IntVar(&c.DownloadRetries, "max-retries", c.DownloadRetries, "retries of a download answered with 429 or 5xx")
+	fs.DurationVar(&c.RetryDelay, "retry-delay", c.RetryDelay, "initial delay between download retries, doubled on each retry")
+	fs.IntVar(&c.UploadRetries, "upload-retries", c.UploadRetries, "retries of a note upload, which failed with a server error")
+	fs.DurationVar(&c.UploadRetryDelay, "upload-retry-delay", c.UploadRetryDelay, "initial delay between upload retries, doubled on each retry")
+	fs.Float64Var(&c.Rate, "rate", c.Rate, "maximum rate of page downloads per second of all download workers together, 0 doesn't limit it")
+	fs.StringVar(&c.UserAgent, "user-agent", c.UserAgent, "User-Agent header of all download requests")
+	fs.StringVar(&c.CACert, "ca-cert", c.CACert, "PEM file of root certificates trusted in addition to the system's, e.g. of a corporate proxy intercepting TLS")
+	fs.BoolVar(&c.Insecure, "insecure", c.Insecure, "INSECURE: skip the verification of server certificates, a last resort for self-signed certificates, prefer -ca-cert")
+	fs.BoolVar(&c.ParseOnDownload, "parse-on-download", c.ParseOnDownload, "parse pages while downloading them and pass the parsed trees on instead of their sources, no effect on pages read from -cache-dir")
+	fs.StringVar(&c.Model, "model", c.Model, "name of the Anki note model used for all notes, -mode cloze defaults to \"" + defaultClozeModel + "\"")
+	fs.StringVar(&c.Output, "output", c.Output, "destination of the notes: anki (upload via AnkiConnect), apkg (write an Anki package to -output-file), tsv (write tab separated rows to -output-file) or json (write a JSON array to -output-file)")
+	fs.StringVar(&c.OutputFile, "output-file", c.OutputFile, "file written by -output apkg, tsv or json, - writes tsv and json to stdout (default notes.<output>)")
+	fs.BoolVar(&c.SkipEmpty, "skip-empty", c.SkipEmpty, "don't create the decks of packages, which produced no cards")
+	fs.StringVar(&c.DeckSep, "deck-sep", c.DeckSep, "separator of the deck levels in the url file, the arguments and -deck-prefix, e.g. / for Go/strings, which is replaced by Anki's ::")
+	fs.StringVar(&c.DeckPrefix, "deck-prefix", c.DeckPrefix, "root deck all decks are moved below, keeping their leaf, e.g. Go moves GoLang::StdLib::bytes to Go::GoLang::StdLib::bytes")
+	fs.IntVar(&c.DeckPrefixReplace, "deck-prefix-replace", c.DeckPrefixReplace, "number of leading deck levels replaced by -deck-prefix, e.g. 2 moves GoLang::StdLib::bytes to Go::bytes")
+	fs.IntVar(&c.TaskLimit, "limit", c.TaskLimit, "process only the first n pairs not skipped by the -checkpoint, 0 processes all")
+}
+
+// returns an error naming the first invalid tunable of `c`.
+func (c Config) Check() error {
+	if c.DownloadWorkers <= 0 || c.ProcessWorkers <= 0 {
+		return fmt.Errorf("worker counts must be positive, got -download-workers=%d -process-workers=%d", c.DownloadWorkers, c.ProcessWorkers)
+	}
+	if c.DownloadRetries < 0 || c.RetryDelay <= 0 {
+		return fmt.Errorf("invalid retry settings -max-retries=%d -retry-delay=%v", c.DownloadRetries, c.RetryDelay)
+	}
+	if c.UploadRetries < 0 || c.UploadRetryDelay <= 0 {
+		return fmt.Errorf("invalid retry settings -upload-retries=%d -upload-retry-delay=%v", c.UploadRetries, c.UploadRetryDelay)
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("-rate must not be negative, got %v", c.Rate)
+	}
+	if c.HttpTimeout <= 0 {
+		return fmt.Errorf("-http-timeout must be positive, got %v", c.HttpTimeout)
+	}
+	outputs := []string{outputAnki, outputApkg, outputTsv, outputJson}
+	if !slices.Contains(outputs, c.Output) {
+		return fmt.Errorf("unknown -output '%s', expected one of %s", c.Output, strings.Join(outputs, ", "))
+	}
+	if c.OutputFile == "-" && c.Output == outputApkg {
+		return fmt.Errorf("-output apkg can't be written to stdout")
+	}
+	if c.Mode != modeBasic && c.Mode != modeCloze {
+		return fmt.Errorf("unknown -mode '%s', expected %s or %s", c.Mode, modeBasic, modeCloze)
+	}
+	if c.DeckSep == "" || strings.ContainsFunc(c.DeckSep, unicode.IsSpace) {
+		return fmt.Errorf("-deck-sep must be non-empty without whitespace, got '%s'", c.DeckSep)
+	}
+	if c.DeckPrefixReplace < 0 || strings.ContainsFunc(c.DeckPrefix, unicode.IsSpace) {
+		return fmt.Errorf("invalid deck settings -deck-prefix='%s' -deck-prefix-replace=%d", c.DeckPrefix, c.DeckPrefixReplace)
+	}
+	return nil
+}
+
+// returns the limiter shared by all downloads according to `c.Rate`, nil if the rate is unlimited.
+func (c Config) NewLimiter() *rate.Limiter {
+	if c.Rate <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(c.Rate), 1)
+}
+
+// returns the Anki deck of the deck `deck` of a url file, whose levels are separated by `c.DeckSep`,
+// e.g. AnkiDeck("Go/strings") -> Go::strings with -deck-sep /.
+func (c Config) AnkiDeck(deck string) string {
+	if c.DeckSep == ankiDeckSep {
+		return deck
+	}
+	return strings.ReplaceAll(deck, c.DeckSep, ankiDeckSep)
+}
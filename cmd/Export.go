@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// opens the output file `fp` for writing, `-` denotes stdout.
+func CreateOutput(fp string) (io.WriteCloser, error) {
+	if fp == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(fp)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// escapes tabs and newlines of an HTML field, so it fits into a single TSV cell.
+// The HTML entities render identically, also inside <pre> blocks.
+var tsvEscaper = strings.NewReplacer("\t", "&#9;", "\r", "", "\n", "&#10;")
+
+// writes the notes of all tasks as `deck<TAB>front<TAB>back<TAB>impl<TAB>tags` rows to `w`,
+// prefixed by the file headers of Anki's text importer.
+// Returns the summary of the written notes, once `in` is closed.
+func TsvWriter(ctx context.Context, cfg Config, w io.Writer, in <-chan Task) (summary Summary) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprint(bw, "#separator:tab\n#html:true\n#deck column:1\n#tags column:5\n")
+	for task := range in {
+		if ctx.Err() != nil {
+			return
+		}
+		summary.Decks++
+		if task.err != nil {
+			slog.Warn("skipped failed task", "deck", task.deck, "url", task.url, "err", task.err)
+			summary.Fail(task)
+			continue
+		}
+		for _, note := range task.notes {
+			fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%s\n",
+				tsvEscaper.Replace(note.DeckName),
+				tsvEscaper.Replace(note.Fields[cfg.FieldMap.Front]),
+				tsvEscaper.Replace(note.Fields[cfg.FieldMap.Back]),
+				tsvEscaper.Replace(note.Fields[cfg.FieldMap.Impl]),
+				strings.Join(note.Tags, " "),
+			)
+		}
+		summary.Added += len(task.notes)
+		slog.Info("wrote notes", "deck", task.deck, "notes", len(task.notes))
+	}
+	if err := bw.Flush(); err != nil {
+		slog.Error("writing the rows failed", "err", err)
+		summary.Errors++
+	}
+	return
+}
+
+// a generated note as written by JsonWriter
+type JsonNote struct {
+	Deck string `json:"deck"`
+	Model string `json:"model"`
+	Front string `json:"front"`
+	Back string `json:"back"`
+	Impl string `json:"impl"`
+	Tags []string `json:"tags"`
+	Url string `json:"url"`
+}
+
+// returns the notes of `t` in their exported form, reading their fields named by `fields`.
+func (t Task) JsonNotes(fields FieldMap) []JsonNote {
+	res := make([]JsonNote, 0, len(t.notes))
+	for _, note := range t.notes {
+		tags := note.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		res = append(res, JsonNote{
+			Deck: note.DeckName,
+			Model: note.ModelName,
+			Front: note.Fields[fields.Front],
+			Back: note.Fields[fields.Back],
+			Impl: note.Fields[fields.Impl],
+			Tags: tags,
+			Url: t.url,
+		})
+	}
+	return res
+}
+
+// writes the notes of all tasks as a single JSON array of JsonNote objects to `w`.
+// Returns the summary of the written notes, once `in` is closed. Once `ctx` is cancelled the array is closed, so it stays valid JSON.
+func JsonWriter(ctx context.Context, cfg Config, w io.Writer, in <-chan Task) (summary Summary) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprint(bw, "[")
+	count := 0
+	for task := range in {
+		if ctx.Err() != nil {
+			break
+		}
+		summary.Decks++
+		if task.err != nil {
+			slog.Warn("skipped failed task", "deck", task.deck, "url", task.url, "err", task.err)
+			summary.Fail(task)
+			continue
+		}
+		for _, note := range task.JsonNotes(cfg.FieldMap) {
+			data, err := json.MarshalIndent(note, "\t", "\t")
+			if err != nil {
+				slog.Error("writing the notes failed", "err", err)
+				summary.Errors++
+				break
+			}
+			if count > 0 {
+				fmt.Fprint(bw, ",")
+			}
+			fmt.Fprint(bw, "\n\t")
+			bw.Write(data)
+			count++
+			summary.Added++
+		}
+		slog.Info("wrote notes", "deck", task.deck, "notes", len(task.notes))
+	}
+	fmt.Fprint(bw, "\n]\n")
+	if err := bw.Flush(); err != nil {
+		slog.Error("writing the notes failed", "err", err)
+		summary.Errors++
+	}
+	return
+}
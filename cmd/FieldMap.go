@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maps the parts of a generated note onto the field names of the note model.
+// Implements flag.Value, parsing `front=<field>,back=<field>,impl=<field>`, omitted parts keep their field.
+type FieldMap struct {
+	Front string // identifier or header of a symbol
+	Back string // documentation block of a symbol
+	Impl string // source code of a symbol
+}
+
+var defaultFieldMap = FieldMap{
+	Front: fieldIdentifier,
+	Back: fieldDeclaration,
+	Impl: fieldImplementation,
+}
+
+// returns the field names in the order front, back, impl.
+func (m FieldMap) Names() []string {
+	return []string{m.Front, m.Back, m.Impl}
+}
+
+func (m *FieldMap) String() string {
+	if m == nil {
+		return ""
+	}
+	return fmt.Sprintf("front=%s,back=%s,impl=%s", m.Front, m.Back, m.Impl)
+}
+
+func (m *FieldMap) Set(value string) error {
+	res := *m
+	for _, pair := range strings.Split(value, ",") {
+		part, field, ok := strings.Cut(pair, "=")
+		field = strings.TrimSpace(field)
+		if !ok || field == "" {
+			return fmt.Errorf("expected <part>=<field>, got '%s'", pair)
+		}
+		switch strings.TrimSpace(part) {
+		case "front":
+			res.Front = field
+		case "back":
+			res.Back = field
+		case "impl":
+			res.Impl = field
+		default:
+			return fmt.Errorf("unknown part '%s', expected front, back or impl", part)
+		}
+	}
+	if res.Front == res.Back || res.Front == res.Impl || res.Back == res.Impl {
+		return fmt.Errorf("parts have to map to distinct fields, got %s", res.String())
+	}
+	*m = res
+	return nil
+}
@@ -4,25 +4,42 @@ package main
 This script:
 - reads (deck, url) pairs from the file `urlFile`.
 - downlaods for each pair the corresponding HTML source (in parallel)
-- creates cards for each constant block, variable block, function block and type block found in a pairs HTML source (in parallel).
+- creates cards for each constant block, variable block, function block, type block and method block found in a pairs HTML source (in parallel).
 - for each pair adds all found cards to the given deck via AnkiConnect. 
 */
 
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"go/token"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/atselvan/ankiconnect"
 	"github.com/ericchiang/css"
@@ -32,53 +49,231 @@ import (
 )
 
 // starts `workerCount` on channel `in` competing go routines that publish to `out`. 
-func Parallel[T any](out chan<-T, in <-chan T, parallel func(chan<-T, <-chan T), workerCount int) {
+// Blocks until all workers returned and closes `out` afterwards.
+func Parallel[T any](ctx context.Context, out chan<-T, in <-chan T, parallel func(context.Context, chan<-T, <-chan T), workerCount int) {
+	var wg sync.WaitGroup
 	for i := 0; i < workerCount; i++ {
-		go parallel(out, in)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parallel(ctx, out, in)
+		}()
 	}
+	wg.Wait()
+	close(out)
 }
 
+// sends `v` to `out` unless `ctx` is cancelled first. Reports whether `v` was sent.
+func Send[T any](ctx context.Context, out chan<-T, v T) bool {
+	select {
+	case out <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// pauses for `d` unless `ctx` is cancelled first. Reports whether the full duration passed.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// values of the -output flag
+const (
+	outputAnki = "anki"
+	outputApkg = "apkg"
+	outputTsv = "tsv"
+	outputJson = "json"
+)
+
+// values of the -mode flag
+const (
+	modeBasic = "basic"
+	modeCloze = "cloze"
+)
+
+const (
+	defaultUrlFile = "./urls_1.22.0.txt" // used if no `-urls` flag is given
+	defaultModel = "Golang"
+	defaultClozeModel = "Golang Cloze"
+	defaultDownloadWorkers = 5
+	defaultProcessWorkers = 10
+
+	// retries of a download answered with 429 or 5xx
+	defaultDownloadRetries = 5
+	defaultRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+
+	defaultHttpTimeout = 30 * time.Second
+	repoUrl = "https://github.com/DerBrunoIR/GoDoc2Anki"
+
+	// retries of a note upload, which failed with a server error
+	defaultUploadRetries = 5
+	defaultUploadRetryDelay = 100 * time.Millisecond
+
+	// interval of the -progress log lines
+	progressInterval = 5 * time.Second
+
+	// queue buffer size per worker of the consuming stage
+	queueBufferPerWorker = 20
+	// the upload queue is consumed by a single uploader, which is the slowest stage 
+	uploadQueueBuffer = 1000
+)
+
+// default fields of the note model, which are filled by the generated notes
 const (
-	urlFile = "./urls_1.22.0.txt" // TODO: change this to your URL's file.
+	fieldIdentifier = "Identifier"
+	fieldDeclaration = "Declaration"
+	fieldImplementation = "Implementation"
+)
+
+// separator of the levels of Anki's nested decks
+const ankiDeckSep = "::"
+
+// version of the program, set by `go build -ldflags "-X main.version=<version>"`
+var version = "devel"
+
+const deprecatedTag = "deprecated"
+
+var (
+	majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+	goVersionPattern = regexp.MustCompile(`[0-9]+\.[0-9]+(\.[0-9]+)?`)
+)
+
+var (
+	deprecatedPattern = regexp.MustCompile(`^\s*Deprecated:`)
 )
 
-// datatype, that is passed between pipeline components
+// datatype, that is passed between pipeline components.
+// A task is owned by one stage at a time: the stage receiving it may modify it, but must not touch it anymore once it sent it on.
+// Copies of a task share its notes and page, use Copy to hand a task to several goroutines.
 type Task struct {
 	url, deck string 
+	importPath string // overrides the import path derived from url
+	model string // name of the Anki note model
+	settings CardSettings // settings of the notes added to the task, see AddNote
+	pair UrlPair // pair the task was created from by TaskGenerator
+	dir string // directory of a local package, whose notes are extracted from its source by SourceProcessor, see -source-dir
 	html []byte
+	root *html.Node // parsed page, replaces `html` with -parse-on-download
 	notes []ankiconnect.Note
+	seen map[[sha256.Size]byte]bool // hashes of the notes' fronts and backs, see AddNote
+	duplicates int // notes not added by AddNote, as the task holds an identical one
 	err error
 }
 
+// returns the import path of the documented package, unless set explicitly derived from the task's url, 
+// e.g. https://pkg.go.dev/golang.org/x/net/html@v0.15.0 -> golang.org/x/net/html.
+// Falls back to the deck parts below the first two levels, if the url has no path.
 func (t *Task) ImportPath() string {
-	res := strings.SplitN(t.deck, "::", 3)
-	if len(res) < 3 {
-		log.Fatalf("Task::ImportPath:: expected at least 3 DeckParts, got '%s'\n", t.deck)
+	if t.importPath != "" {
+		return t.importPath
+	}
+	if u, err := url.Parse(t.url); err == nil {
+		path, _, _ := strings.Cut(strings.Trim(u.Path, "/"), "@")
+		if path != "" {
+			return path
+		}
+	}
+	parts := strings.Split(t.deck, ankiDeckSep)
+	return strings.ToLower(strings.Join(parts[min(2, len(parts)-1):], "/"))
+}
+
+// returns the pair the task was created from, as given by the url file before -deck-prefix moved its deck.
+// Tasks not created by TaskGenerator return their deck and url.
+func (t Task) Pair() UrlPair {
+	if t.pair.Url == "" {
+		return UrlPair{Deck: t.deck, Url: t.url}
 	}
-	return strings.ToLower(strings.ReplaceAll(res[2], "::", "."))
+	return t.pair
 }
 
-func (t *Task) AddNote(front, back, impl string) {
+// returns the name identifiers of the documented package are qualified with, 
+// i.e. the last element of the import path without major version suffixes,
+// e.g. https://pkg.go.dev/net/http -> http, https://pkg.go.dev/github.com/go-resty/resty/v2 -> resty.
+func (t *Task) PackageName() string {
+	parts := strings.Split(t.ImportPath(), "/")
+	name := parts[len(parts)-1]
+	if majorVersion.MatchString(name) && len(parts) > 1 {
+		name = parts[len(parts)-2]
+	}
+	name, _, _ = strings.Cut(name, ".v") // gopkg.in/yaml.v2
+	return name
+}
+
+// adds a note to the task, unless it already holds a note with the same front and back, ignoring differences in whitespace.
+func (t *Task) AddNote(front, back, impl string, tags ...string) {
+	key := sha256.Sum256([]byte(strings.Join(strings.Fields(front), " ") + "\x00" + strings.Join(strings.Fields(back), " ")))
+	if t.seen[key] {
+		t.duplicates++
+		slog.Debug("collapsed duplicate note", "deck", t.deck, "front", front)
+		return
+	}
+	if t.seen == nil {
+		t.seen = make(map[[sha256.Size]byte]bool)
+	}
+	t.seen[key] = true
 	t.notes = append(t.notes, ankiconnect.Note{
 		DeckName: t.deck,
-		ModelName: "Golang", 
+		ModelName: t.model, 
 		Fields: ankiconnect.Fields{
-			"Identifier": front,
-			"Declaration": back,
-			"Implementation": impl,
+			t.settings.FieldMap.Front: front,
+			t.settings.FieldMap.Back: back,
+			t.settings.FieldMap.Impl: impl,
 		},
+		Tags: append(slices.Clone(t.settings.Tags), tags...),
 	})
-	//fmt.Printf("--------------------\n%s\n---------------\n%s\n\n", front, back)
+	slog.Debug("added note", "deck", t.deck, "front", front)
+}
+
+// returns a copy of the task, which shares no mutable state with `t`, 
+// so both can be processed and extended by AddNote concurrently.
+func (t Task) Copy() Task {
+	t.notes = slices.Clone(t.notes)
+	t.seen = maps.Clone(t.seen)
+	t.root = HTMLTrees.Clone(t.root)
+	return t
+}
+
+// moves the task's deck below `prefix`, see PrefixDeck. 
+// The import path stays the one derived from the original deck.
+func (t *Task) PrefixDeck(prefix string, replace int) {
+	if prefix == "" {
+		return
+	}
+	t.importPath = t.ImportPath()
+	t.deck = PrefixDeck(t.deck, prefix, replace)
+}
+
+// returns `deck` below the root deck `prefix`, after removing its first `replace` levels. 
+// The leaf of `deck` is always kept, e.g. PrefixDeck("GoLang::StdLib::bytes", "Go", 2) -> Go::bytes.
+// An empty `prefix` returns `deck` unchanged.
+func PrefixDeck(deck, prefix string, replace int) string {
+	if prefix == "" {
+		return deck
+	}
+	parts := strings.Split(deck, ankiDeckSep)
+	parts = parts[min(max(replace, 0), len(parts)-1):]
+	return strings.TrimSuffix(prefix, ankiDeckSep) + ankiDeckSep + strings.Join(parts, ankiDeckSep)
 }
 
 func (t Task) String() string {
 	return fmt.Sprintf("Task{ deck: %s, err: %v }", t.deck, t.err)
 }
 
-func NewTask(url, deck string) Task {
+func NewTask(url, deck, model string) Task {
 	return Task{
 		url: url,
 		deck: deck,
+		model: model,
+		settings: DefaultCardSettings(),
 		notes: make([]ankiconnect.Note, 0),
 		err: nil,
 	}
@@ -86,346 +281,1731 @@ func NewTask(url, deck string) Task {
 
 // construct and run pipeline
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	cfg := DefaultConfig()
+	cfg.RegisterFlags(flag.CommandLine)
+	urlFile := flag.String("urls", defaultUrlFile, "file containing (deck, url) pairs, one per line, - reads the pairs from stdin")
+	strict := flag.Bool("strict", false, "exit on malformed lines of the url file instead of skipping them")
+	profileName := flag.String("profile", defaultProfile, "selectors matching the layout of the documentation pages, one of " + strings.Join(ProfileNames(), ", "))
+	rawBaseUrl := flag.String("base-url", "", "scheme and host links of the cards point to instead of those of the page, e.g. http://localhost:6060 of a local godoc server")
+	ankiUrl := flag.String("anki-url", "", "AnkiConnect base url, e.g. http://192.168.0.10:8765 (default http://localhost:8765)")
+	rawAddedSince := flag.String("added-since", "", "generate only notes of functions, types and methods added in this Go version or later, e.g. 1.22")
+	createModel := flag.Bool("create-model", false, "create the -model in Anki, if it doesn't exist")
+	goVersion := flag.String("go-version", "", "tag every note with go:<version>, derived from the -urls file name by default")
+	tags := flag.String("tags", "", "comma separated tags added to every note, e.g. stdlib,interview-prep")
+	logLevel := flag.String("log-level", "info", "minimum level of logged messages: debug, info, warn or error")
+	showProgress := flag.Bool("progress", false, "log the number of downloaded, processed and finished tasks every " + progressInterval.String())
+	dryRun := flag.Bool("dry-run", false, "print the generated notes instead of uploading them, Anki is not required")
+	checkpointFile := flag.String("checkpoint", "", "file recording uploaded (deck, url) pairs, which are skipped on the next run")
+	sourceDir := flag.String("source-dir", "", "directory of local Go packages, whose notes are extracted from their source instead of pkg.go.dev pages, replacing the url file")
+	failuresFile := flag.String("failures", "", "file the (deck, url) pairs of failed tasks are written to in the format of the url file, e.g. to rerun them by -urls")
+	discover := flag.Bool("discover", false, "replace each pair by the packages listed in the directories of its page, e.g. of a module like https://pkg.go.dev/golang.org/x/net")
+	noResume := flag.Bool("no-resume", false, "don't skip pairs recorded in the -checkpoint file")
+	cacheDir := flag.String("cache-dir", "", "directory caching downloaded HTML sources by url")
+	cacheTTL := flag.Duration("cache-ttl", 0, "age after which cached HTML sources are downloaded again, 0 keeps them forever")
+	refresh := flag.Bool("refresh", false, "ignore cached HTML sources, but update the -cache-dir")
+	flag.Parse()
+	set := make(map[string]bool) // flags given explicitly
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
 
-	client := ankiconnect.NewClient()
-	err := client.Ping()
+	level, err := ParseLogLevel(*logLevel)
 	if err != nil {
-		log.Fatal("main::client.Ping::", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	log.Println("Connected Anki Client")
+	slog.SetDefault(NewLogger(os.Stderr, level))
 
-	downloadQueue := make(chan Task, 100)
-	processQueue := make(chan Task, 100)
-	ankiQueue := make(chan Task, 1000)
+	if err := cfg.Check(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cfg.Limiter = cfg.NewLimiter()
+	if cfg.OutputFile == "" {
+		cfg.OutputFile = "notes." + cfg.Output
+	}
 
-	go TaskGenerator(urlFile, downloadQueue)
-	go Parallel(processQueue, downloadQueue, HtmlDownloader, 5)	
-	go Parallel(ankiQueue, processQueue, HtmlProcessor, 10)
+	if *rawAddedSince != "" {
+		version, err := ParseGoVersion(*rawAddedSince)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -added-since '%s', expected a Go version like 1.22\n", *rawAddedSince)
+			os.Exit(1)
+		}
+		cfg.AddedSince = version
+	}
 
-	go NoteUploader(client, ankiQueue)
+	if cfg.Mode == modeCloze && !set["model"] {
+		cfg.Model = defaultClozeModel
+	}
 
-	fmt.Println("[ press enter to exit ]")
-	fmt.Scanln()
-}
+	if p, ok := profiles[*profileName]; ok {
+		cfg.Profile = p
+	} else {
+		fmt.Fprintf(os.Stderr, "unknown -profile '%s', expected one of %s\n", *profileName, strings.Join(ProfileNames(), ", "))
+		os.Exit(1)
+	}
+	if *rawBaseUrl != "" {
+		u, err := url.Parse(*rawBaseUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "invalid -base-url '%s', expected http(s)://host[:port][/path]\n", *rawBaseUrl)
+			os.Exit(1)
+		}
+		cfg.BaseUrl = u
+	}
 
-// reads (deck, url) pairs from file and wraps each in a task instance.
-func TaskGenerator(fp string, out chan<-Task) {
-	file, err := os.Open(fp)
+	// (deck, url) pairs given as arguments replace the default url file
+	pairs, err := ParseArgs(flag.Args())
 	if err != nil {
-		log.Fatal("TaskGenerator::", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	task_count := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		var url, deck string
-		n, err := fmt.Sscanf(line, "%s %s", &deck, &url)
-		if n == 0 && err == io.EOF { // ignore empty lines
-			continue
+	if len(pairs) > 0 && !set["urls"] {
+		*urlFile = ""
+	}
+	var sourceDirs []string // package directories below -source-dir
+	if *sourceDir != "" {
+		if len(pairs) > 0 || set["urls"] || *discover {
+			fmt.Fprintln(os.Stderr, "-source-dir replaces the url file, pairs and -discover")
+			os.Exit(1)
+		}
+		if cfg.AddedSince != nil {
+			fmt.Fprintln(os.Stderr, "-added-since needs the versions of pkg.go.dev pages, which the source of -source-dir lacks")
+			os.Exit(1)
 		}
+		if info, err := os.Stat(*sourceDir); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "-source-dir '%s' is no directory\n", *sourceDir)
+			os.Exit(1)
+		}
+		sourceDirs, err = PackageDirs(*sourceDir, cfg.ExportedOnly)
 		if err != nil {
-			log.Fatal("TaskGenerator::", err)
+			fmt.Fprintf(os.Stderr, "reading -source-dir '%s' failed: %s\n", *sourceDir, err)
+			os.Exit(1)
+		}
+		*urlFile = ""
+	}
+	if *urlFile != "" {
+		if err := CheckUrlFile(*urlFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		task := NewTask(url, deck)
-		out <- task
-		task_count++
 	}
-	log.Printf("'%s' loaded file, %d tasks created\n", fp, task_count)
-}
 
-// download HTML source, found at the tasks url, for any given task instance
-func HtmlDownloader(out chan<-Task, in <-chan Task) {
-	task := <-in
-	Outer: for {
-		resp, err := http.Get(task.url)
+	if *goVersion == "" {
+		*goVersion = goVersionPattern.FindString(filepath.Base(*urlFile))
+	}
+	if *goVersion != "" {
+		cfg.Tags = append(cfg.Tags, "go:" + strings.TrimPrefix(*goVersion, "go"))
+	}
+	// the url file is read up front, so the note models its lines name can be checked before the first upload
+	if *urlFile != "" {
+		filePairs, err := ReadUrlFile(*urlFile, *strict)
 		if err != nil {
-			task.err = fmt.Errorf("HtmlDownloader::failed to downlaod html for task %v: %w", task, err)
-			out <- task
-			continue
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		
-		// handle response code
-		switch resp.StatusCode {
-			case 200:
-			case 429:
-				time.Sleep(500 * time.Millisecond)
-				continue Outer
-			default: 
-			log.Fatal(resp.Status)
+		pairs = append(filePairs, pairs...)
+	}
+	for _, tag := range strings.Split(*tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.ContainsFunc(tag, unicode.IsSpace) {
+			fmt.Fprintf(os.Stderr, "tags must not contain whitespace, got '%s'\n", tag)
+			os.Exit(1)
 		}
+		if tag != "" && !slices.Contains(cfg.Tags, tag) {
+			cfg.Tags = append(cfg.Tags, tag)
+		}
+	}
 
-		html, err := io.ReadAll(resp.Body)
+	var checkpoint *Checkpoint
+	if *checkpointFile != "" {
+		var err error
+		checkpoint, err = OpenCheckpoint(*checkpointFile, !*noResume)
 		if err != nil {
-			task.err = fmt.Errorf("HtmlDownloader::failed to read html body for %v: %w", task, err)
-			out <- task
-			continue
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		task.html = html
-		log.Printf("'%s' downloaded documentation (%v bytes)\n", task.url, len(task.html))
-		out<-task
-		resp.Body.Close()
-		task = <-in
 	}
-}
-
-// parse a tasks HTML source and add a Anki note to the task for each constant block, variable block, function block and type block found  
-func HtmlProcessor(out chan<- Task, in <-chan Task) {
-	for task := range in {
-		root, err := html.Parse(bytes.NewBuffer(task.html))
-		if err != nil {
-			log.Fatal("HTMLProcessor::root::", err)
-		}
-		
-		// local hrefs to global hrefs
-		
-		base, err := url.Parse(task.url)
-		HTMLTrees.Modify(root, func(node *html.Node) (res error) {
-			res = nil
-			for i := 0; i < len(node.Attr); i++ {
-				if node.Attr[i].Key == "href" {
-					link, err := url.Parse(node.Attr[i].Val)
-					if err == nil {
-						target := base.ResolveReference(link)
-						node.Attr[i].Val = target.String()
-						//fmt.Printf("Debug: %#v\n", target.String())
-					}
-				}
-				i++
-			}
-			return
-		})
-
-		// selectors 
 
-		doc_src_header, err := css.Parse("a.Documentation-source")
+	var cache *HtmlCache
+	if *cacheDir != "" {
+		var err error
+		cache, err = NewHtmlCache(*cacheDir, *cacheTTL, *refresh)
 		if err != nil {
-			log.Fatal("HTMLProcessor::doc_src_header::", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		doc_src_add_prefix := func(root *html.Node, name string) {
-			nodes := doc_src_header.Select(root)
-			if len(nodes) == 0 {
-				log.Fatalf("HTMLProcessor::doc_src_add_prefix::no nodes found\n")
-			}
-			for _, node := range nodes {
-				//fmt.Printf("Debug: %s\n", HTMLTrees.HTMLString(node))
-				node.FirstChild.Data = name + "." + node.FirstChild.Data
-				//fmt.Printf("Debug: %s\n", HTMLTrees.HTMLString(node))
-			}
-		}
-
-		// variables 
+	}
 
-		var_selector, err := css.Parse("section.Documentation-variables div.Documentation-declaration")
-		if err != nil {
-			log.Fatal("HTMLProcessor::var_selector::", err)
+	client := ankiconnect.NewClient()
+	if *ankiUrl != "" {
+		if err := CheckAnkiUrl(*ankiUrl); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		var_span_selector, err := css.Parse("span[data-kind='variable']")
-		if err != nil {
-			log.Fatal(err)
+		client.SetURL(*ankiUrl)
+	}
+	if !*dryRun && cfg.Output == outputAnki {
+		if err := client.Ping(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot reach AnkiConnect at '%s': %s\n", client.Url, err.Message)
+			os.Exit(1)
 		}
-		
-		variables := var_selector.Select(root)
-		//fmt.Printf("found %d variables\n", len(variables))
-
-		for i := 0; i < len(variables); i++ {
-			variable := variables[i]
-
-			// append deck importPath as prefix to variable name
-			for _, span := range var_span_selector.Select(variable) {
-				id, err := GetHtmlAttributeByKey(span, "id")
+		slog.Info("connected to AnkiConnect", "url", client.Url)
+		// models named by lines of the url file are created and checked as well
+		for _, model := range UrlPairModels(pairs, cfg.Model) {
+			if *createModel {
+				created, err := CreateModel(client, model, cfg.FieldMap, cfg.Mode == modeCloze)
 				if err != nil {
-					log.Fatal(err)
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
 				}
-				pattern := regexp.MustCompile(fmt.Sprintf(`(?P<id>%s)`,id.Val))
-				nodes := HTMLTrees.MatchingNodes(span, pattern)
-				//fmt.Println("debug: len(nodes) = ", len(nodes))
-				for _, node := range nodes {
-					node.Data = pattern.ReplaceAllString(node.Data, task.ImportPath() + ".${id}")
-					//fmt.Println("debug: ", node.Data)
+				if created {
+					slog.Info("created note model", "model", model)
 				}
 			}
-
-			// find following <p>...</p>
-			nodes := []*html.Node{variable}
-			for c := variable.NextSibling.NextSibling; c != nil && c.Data == "p"; c = c.NextSibling.NextSibling { // skip whitspace div
-				nodes = append(nodes, c)
+			if err := CheckModel(client, model, cfg.FieldMap.Names()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
-
-			front := HTMLTrees.HTMLString(
-				HTMLTrees.DeepCopySubtrees(root, nodes),
-			)
-
-			task.AddNote(front, front, "")
 		}
+	}
 
-		// constants
+	// Ctrl-C stops all stages, a second Ctrl-C kills the program
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		slog.Warn("shutting down, press ctrl+c again to force exit")
+	}()
 
-		const_selector, err := css.Parse("section.Documentation-constants div.Documentation-declaration")
-		if err != nil {
-			log.Fatal("HTMLProcessor::const_selector::", err)
-		}
-		const_span_selector, err := css.Parse("span[data-kind='constant']")
+	// decks are requested before the pipeline starts, so an unreachable Anki fails early
+	var anki AnkiApi
+	var decks DeckSet
+	if !*dryRun && cfg.Output == outputAnki {
+		anki = NewAnkiClient(ctx, client, cfg.HttpTimeout)
+		all, err := anki.GetDecks()
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "requesting the decks failed: %s\n", err.Message)
+			os.Exit(1)
 		}
+		decks = NewDeckSet(*all...)
+	}
 
-		constants := const_selector.Select(root)
-		//fmt.Printf("found %d constants\n", len(constants))
+	downloadQueue := make(chan Task, queueBufferPerWorker * cfg.DownloadWorkers)
+	processQueue := make(chan Task, queueBufferPerWorker * cfg.ProcessWorkers)
+	ankiQueue := make(chan Task, uploadQueueBuffer)
 
-		for i := 0; i < len(constants); i++ {
-			constant := constants[i]
+	httpClient, err := NewHttpClient(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cfg.Insecure {
+		slog.Warn("-insecure: server certificates aren't verified")
+	}
+	if *discover {
+		cfg.DiscoverClient = httpClient
+	}
+	downloader := func(ctx context.Context, out chan<-Task, in <-chan Task) {
+		HtmlDownloader(ctx, cfg, httpClient, cache, out, in)
+	}
+	processor := func(ctx context.Context, out chan<-Task, in <-chan Task) {
+		HtmlProcessor(ctx, cfg, httpClient, out, in)
+	}
 
-			// append deck importPath as prefix to variable name
-			for _, span := range const_span_selector.Select(constant) {
-				id, err := GetHtmlAttributeByKey(span, "id")
-				if err != nil {
-					log.Fatal(err)
-				}
-				pattern := regexp.MustCompile(fmt.Sprintf(`(?P<id>%s)`,id.Val))
-				nodes := HTMLTrees.MatchingNodes(span, pattern)
-				//fmt.Println("debug: len(nodes) = ", len(nodes))
-				for _, node := range nodes {
-					node.Data = pattern.ReplaceAllString(node.Data, task.ImportPath() + ".${id}")
-					//fmt.Println("debug: ", node.Data)
-				}
-			}
+	// tasks leaving a stage pass a relay, which counts them for -progress
+	var progress *Progress
+	if *showProgress {
+		progress = NewProgress()
+		go progress.Log(ctx, progressInterval)
+	}
+	downloaded := make(chan Task)
+	processed := make(chan Task)
+	finalQueue := make(chan Task)
 
-			// find following <p>...</p>
-			nodes := []*html.Node{constant}
-			for c := constant.NextSibling.NextSibling; c != nil && c.Data == "p"; c = c.NextSibling.NextSibling { // skip whitspace div
-				nodes = append(nodes, c)
-			}
+	if *sourceDir != "" {
+		// local packages need no download
+		go SourceGenerator(ctx, cfg, *sourceDir, sourceDirs, checkpoint, progress, downloaded)
+		processor = func(ctx context.Context, out chan<-Task, in <-chan Task) {
+			SourceProcessor(ctx, cfg, out, in)
+		}
+	} else {
+		go TaskGenerator(ctx, cfg, pairs, checkpoint, progress, downloadQueue)
+		go Parallel(ctx, downloaded, downloadQueue, downloader, cfg.DownloadWorkers)	
+	}
+	go progress.Relay(ctx, stageDownloaded, processQueue, downloaded)
+	go Parallel(ctx, processed, processQueue, processor, cfg.ProcessWorkers)
+	go progress.Relay(ctx, stageProcessed, ankiQueue, processed)
+	go progress.Relay(ctx, stageFinished, finalQueue, ankiQueue)
 
-			front := HTMLTrees.HTMLString(
-				HTMLTrees.DeepCopySubtrees(root, nodes),
-			)
+	// returns once every task passed the pipeline or the pipeline got cancelled
+	var summary Summary
+	switch {
+	case *dryRun:
+		summary = NotePrinter(ctx, cfg, os.Stdout, finalQueue)
+	case cfg.Output == outputApkg:
+		summary = ApkgWriter(ctx, cfg, finalQueue)
+	case cfg.Output == outputTsv || cfg.Output == outputJson:
+		file, err := CreateOutput(cfg.OutputFile)
+		if err != nil {
+			slog.Error("creating the output failed", "err", err)
+			os.Exit(1)
+		}
+		if cfg.Output == outputTsv {
+			summary = TsvWriter(ctx, cfg, file, finalQueue)
+		} else {
+			summary = JsonWriter(ctx, cfg, file, finalQueue)
+		}
+		if err := file.Close(); err != nil {
+			slog.Error("closing the output failed", "file", cfg.OutputFile, "err", err)
+			summary.Errors++
+		}
+	default:
+		summary = NoteUploader(ctx, cfg, anki, decks, checkpoint, finalQueue)
+	}
+	checkpoint.Close()
+	if *failuresFile != "" {
+		if written, err := WriteUrlFile(*failuresFile, summary.Failed); err != nil {
+			slog.Error("writing the failures failed", "file", *failuresFile, "err", err)
+			summary.Errors++
+		} else if written > 0 {
+			slog.Info("wrote failed pairs", "file", *failuresFile, "pairs", written)
+		}
+	}
+	if progress != nil {
+		slog.Info("progress", "tasks", progress.String())
+	}
+	summary.Print(os.Stderr)
+	if ctx.Err() != nil {
+		slog.Warn("interrupted")
+		os.Exit(1)
+	}
+	if summary.Errors > 0 {
+		slog.Error("some tasks failed", "errors", summary.Errors)
+		os.Exit(1)
+	}
+}
 
-			task.AddNote(front, front, "")
+// returns the http client shared by all downloads. 
+// Idle connections are kept for each download worker, so connections to pkg.go.dev get reused.
+// Requests use the proxies of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+// and trust the certificates of `cfg.CACert` besides the system's.
+func NewHttpClient(cfg Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConnsPerHost = cfg.DownloadWorkers
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading -ca-cert failed: %w", err)
 		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in -ca-cert '%s'", cfg.CACert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout: cfg.HttpTimeout,
+		Transport: transport,
+	}, nil
+}
 
+// ensures the url file at `fp` exists and is readable before the pipeline is started.
+// `-` denotes stdin, which is always readable.
+func CheckUrlFile(fp string) error {
+	if fp == "-" {
+		return nil
+	}
+	file, err := os.Open(fp)
+	if err != nil {
+		return fmt.Errorf("cannot read url file '%s': %w", fp, err)
+	}
+	return file.Close()
+}
 
-		// functions
+// ensures `raw` is an absolute http(s) url usable as AnkiConnect endpoint.
+func CheckAnkiUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid AnkiConnect url '%s': %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid AnkiConnect url '%s': expected http(s)://host:port", raw)
+	}
+	return nil
+}
 
-		func_selector, err := css.Parse("div.Documentation-function")
+// reads the (deck, url) pairs of the url file `fp`, `-` reads them from stdin. Blank lines and lines starting with `#` are skipped.
+// Malformed lines are skipped with a warning, unless `strict` is set, which fails on them. Note models named by lines are logged, as any trailing text of a line names one.
+func ReadUrlFile(fp string, strict bool) ([]UrlPair, error) {
+	pairs := make([]UrlPair, 0)
+	var r io.Reader = os.Stdin
+	if fp != "-" {
+		file, err := os.Open(fp)
 		if err != nil {
-			log.Fatal("HTMLProcessor::func_selector::", err)
+			return nil, fmt.Errorf("cannot read url file '%s': %w", fp, err)
 		}
-		functions := func_selector.Select(root)
-		//fmt.Printf("found %d functions\n", len(functions))
-
-		func_header_selector, err := css.Parse("div.Documentation-function h4.Documentation-functionHeader")
+		defer file.Close()
+		r = file
+	}
+	scanner := bufio.NewScanner(r)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") { // ignore blank lines and comments
+			continue
+		}
+		deck, url, model, err := ParseUrlLine(line)
 		if err != nil {
-			log.Fatal(err)
+			if strict {
+				return nil, fmt.Errorf("malformed line %d of url file '%s': %w", line_number, fp, err)
+			}
+			slog.Warn("skipped malformed line", "file", fp, "line", line_number, "err", err, "text", line)
+			continue
 		}
-		func_headers := func_header_selector.Select(root)
-		if len(func_headers) != len(functions) {
-			log.Fatalf("HTMLProcessor::unexpected_amount_of_func_headers:: found %d functions and %d headers\n", len(functions), len(func_headers))
+		if model != "" {
+			slog.Info("line names a note model", "file", fp, "line", line_number, "model", model)
 		}
-		for i := 0; i < len(functions); i++ {
-			function := functions[i]
-			header := func_headers[i]
-			doc_src_add_prefix(header, task.ImportPath())
+		pairs = append(pairs, UrlPair{Deck: deck, Url: url, Model: model})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading url file '%s' failed: %w", fp, err)
+	}
+	slog.Info("loaded url file", "file", fp)
+	return pairs, nil
+}
 
-			back := HTMLTrees.HTMLString(
-				HTMLTrees.DeepCopySubtrees(root, []*html.Node{function}),
-			)
-			front := HTMLTrees.HTMLString(
-				HTMLTrees.DeepCopySubtrees(root, []*html.Node{header}),
-			)
-			task.AddNote(front, back, "")
+// returns the distinct note models of `pairs`, led by `model`, which is used for pairs naming none.
+func UrlPairModels(pairs []UrlPair, model string) []string {
+	models := []string{model}
+	for _, pair := range pairs {
+		if pair.Model != "" && !slices.Contains(models, pair.Model) {
+			models = append(models, pair.Model)
 		}
+	}
+	return models
+}
 
-		// types
+// wraps each of the (deck, url) pairs `pairs`, e.g. of the url file, see ReadUrlFile, in a task instance using the note model of the pair or else `cfg.Model`.
+// Pairs done according to `checkpoint` are skipped. With `cfg.DiscoverClient` the pairs are replaced by the packages their pages list. At most `cfg.TaskLimit` tasks are created. Decks are moved below the root deck `cfg.DeckPrefix`.
+// All tasks are created before the first one is sent, so the number of tasks is recorded in `progress` early on.
+// `out` is closed once all tasks are sent or `ctx` is cancelled.
+func TaskGenerator(ctx context.Context, cfg Config, pairs []UrlPair, checkpoint *Checkpoint, progress *Progress, out chan<-Task) {
+	defer close(out)
+	todo := pairs
 
-		type_selector, err := css.Parse("div.Documentation-type")
-		if err != nil {
-			log.Fatal(err)
+	if cfg.DiscoverClient != nil {
+		discovered := make([]UrlPair, 0, len(todo))
+		for _, pair := range todo {
+			found, err := Discover(ctx, cfg, cfg.DiscoverClient, pair)
+			if err != nil {
+				// the pair is kept, so its failure shows in the summary
+				slog.Error("discovering packages failed", "deck", pair.Deck, "url", pair.Url, "err", err)
+				found = []UrlPair{pair}
+			} else {
+				slog.Info("discovered packages", "deck", pair.Deck, "url", pair.Url, "packages", len(found))
+			}
+			discovered = append(discovered, found...)
 		}
-		types := type_selector.Select(root)
-		//fmt.Printf("found %d types\n", len(functions))
+		todo = discovered
+	}
 
-		type_header_selector, err := css.Parse("div.Documentation-type h4.Documentation-typeHeader")
-		if err != nil {
-			log.Fatal("HTMLProcessor::type_header_selector::", err)
+	tasks := make([]Task, 0, len(todo))
+	for _, pair := range todo {
+		task := NewTask(pair.Url, cfg.AnkiDeck(pair.Deck), cfg.Model)
+		task.pair = pair
+		task.settings = cfg.CardSettings
+		if pair.Model != "" {
+			task.model = pair.Model
 		}
-		type_headers := type_header_selector.Select(root)
-		if len(type_headers) != len(types) {
-			log.Fatalf("HTMLProcessor::unexpected_amount_of_type_headers:: %d types and %d headers\n", len(types), len(type_headers))
+		tasks = append(tasks, task)
+	}
+	SendTasks(ctx, cfg, tasks, checkpoint, progress, out)
+}
+
+// moves the decks of `tasks` below -deck-prefix and sends the tasks not done according to `checkpoint` to `out`, at most -limit of them.
+// Their number is recorded in `progress` before the first task is sent.
+func SendTasks(ctx context.Context, cfg Config, tasks []Task, checkpoint *Checkpoint, progress *Progress, out chan<-Task) {
+	todo := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		task.PrefixDeck(cfg.AnkiDeck(cfg.DeckPrefix), cfg.DeckPrefixReplace)
+		// the checkpoint records the decks notes were uploaded to
+		if !checkpoint.Done(task.deck, task.url) {
+			todo = append(todo, task)
 		}
-		for i := 0; i < len(types); i++ {
-			type_ := types[i]
-			header := type_headers[i]
-			doc_src_add_prefix(header, task.ImportPath())
-			back := HTMLTrees.HTMLString(
-				HTMLTrees.DeepCopySubtrees(root, []*html.Node{type_}),
-			)
-			front := HTMLTrees.HTMLString(
-				HTMLTrees.DeepCopySubtrees(root, []*html.Node{header}),
-			)
-			task.AddNote(front, back, "")
+	}
+	skip_count := len(tasks) - len(todo)
+	if cfg.TaskLimit > 0 && len(todo) > cfg.TaskLimit {
+		slog.Info("limited tasks", "limit", cfg.TaskLimit, "tasks", len(todo))
+		todo = todo[:cfg.TaskLimit]
+	}
+	progress.SetTotal(len(todo))
+
+	for i, task := range todo {
+		if !Send(ctx, out, task) {
+			slog.Info("task creation cancelled", "created", i, "tasks", len(todo), "checkpointed", skip_count)
+			return
 		}
+	}
+	slog.Info("tasks created", "tasks", len(todo), "checkpointed", skip_count)
+}
 
-		log.Printf(
-			"'%s' found %d variables, %d constants, %d functions, %d types. Generated %d notes", 
-			task.deck, len(variables), len(constants), len(functions), len(types), len(task.notes),
-		)
-		out <- task 
+// matches the version element of pkg.go.dev urls, e.g. `@v0.20.0` of `/golang.org/x/net@v0.20.0/html`
+var urlVersion = regexp.MustCompile(`@[^/]*`)
+
+// returns the pairs of the packages listed in the directories of the pkg.go.dev page at `pair.Url`, e.g. of a module, 
+// preceded by `pair` itself if its page documents a package. Internal packages are left out unless -exported-only is disabled.
+// Decks of the packages extend `pair.Deck` by their path below the page, urls carry the version of `pair.Url`, 
+// e.g. Go::net https://pkg.go.dev/golang.org/x/net@v0.20.0 lists Go::net::html::atom https://pkg.go.dev/golang.org/x/net/html/atom@v0.20.0.
+func Discover(ctx context.Context, cfg Config, client *http.Client, pair UrlPair) ([]UrlPair, error) {
+	base, err := url.Parse(pair.Url)
+	if err != nil {
+		return nil, err
+	}
+	root, err := DownloadTree(ctx, cfg, client, pair.Url)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.Trim(urlVersion.ReplaceAllString(base.Path, ""), "/")
+	version := strings.TrimPrefix(urlVersion.FindString(base.Path), "@")
+
+	res := make([]UrlPair, 0)
+	if HTMLTrees.FindFirst(root, cfg.Profile.Overview) != nil {
+		res = append(res, pair)
+	}
+	seen := map[string]bool{path: true}
+	for _, anchor := range HTMLTrees.FindAll(root, cfg.Profile.Directories) {
+		link, err := base.Parse(AttrOr(anchor, "href", ""))
+		if err != nil || link.Host != base.Host {
+			continue
+		}
+		pkg := strings.Trim(urlVersion.ReplaceAllString(link.Path, ""), "/")
+		rel, ok := strings.CutPrefix(pkg, path + "/")
+		if !ok || seen[pkg] || cfg.ExportedOnly && slices.Contains(strings.Split(rel, "/"), "internal") {
+			continue
+		}
+		seen[pkg] = true
+		link.Path, link.RawPath, link.RawQuery, link.Fragment = "/" + pkg, "", "", ""
+		if version != "" {
+			link.Path += "@" + version
+		}
+		res = append(res, UrlPair{Deck: pair.Deck + cfg.DeckSep + strings.ReplaceAll(rel, "/", cfg.DeckSep), Url: link.String(), Model: pair.Model})
 	}
+	return res, nil
+}
 
+// a (deck, url) pair given as command line arguments or by a line of the url file
+type UrlPair struct {
+	Deck, Url string
+	Model string // note model of the pair's notes, empty uses the model of -model
 }
 
-func GetHtmlAttribute(node *html.Node, f func(attr html.Attribute) bool) (*html.Attribute, error) {
-	for _, attr := range node.Attr {
-		if f(attr) {
-			return &attr, nil
+// writes `pairs` to the file `fp` in the format of the url file, one `<deck> <url> [<model>]` line per pair, and returns the number of written pairs.
+// Pairs a url file can't hold, e.g. the file:// urls of local packages of -source-dir, are left out with a warning.
+// The file is replaced, so it is empty without pairs.
+func WriteUrlFile(fp string, pairs []UrlPair) (int, error) {
+	var sb strings.Builder
+	written := 0
+	for _, pair := range pairs {
+		if _, _, _, err := ParseUrlLine(pair.Deck + " " + pair.Url); err != nil {
+			slog.Warn("left out a pair the url file can't hold, rerun local packages by -source-dir", "file", fp, "deck", pair.Deck, "url", pair.Url, "err", err)
+			continue
 		}
+		written++
+		sb.WriteString(pair.Deck + " " + pair.Url)
+		if pair.Model != "" {
+			sb.WriteString(" " + pair.Model)
+		}
+		sb.WriteString("\n")
 	}
-	return nil, errors.New("no matching attribute found")
+	return written, os.WriteFile(fp, []byte(sb.String()), 0644)
 }
 
-func GetHtmlAttributeByKey(node *html.Node, key string) (*html.Attribute, error) {
-	return GetHtmlAttribute(node, func(attr html.Attribute) bool {
-		return attr.Key == key
-	})
+// returns the pairs of the command line arguments `args`, 
+// which are either `<deck>=<url>` arguments or alternating deck and url arguments.
+func ParseArgs(args []string) ([]UrlPair, error) {
+	pairs := make([]UrlPair, 0, len(args)/2)
+	for i := 0; i < len(args); i++ {
+		line := ""
+		if deck, url, ok := strings.Cut(args[i], "="); ok && !strings.Contains(deck, "://") {
+			line = deck + " " + url
+		} else if i+1 < len(args) {
+			line = args[i] + " " + args[i+1]
+			i++
+		} else {
+			return nil, fmt.Errorf("argument '%s': missing url", args[i])
+		}
+		deck, url, model, err := ParseUrlLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("arguments '%s': %w", line, err)
+		}
+		pairs = append(pairs, UrlPair{Deck: deck, Url: url, Model: model})
+	}
+	return pairs, nil
 }
 
-// for each task ensure the associated Anki deck exists and upload all Anki notes from `task` to the specified deck.
-func NoteUploader(client *ankiconnect.Client, in <-chan Task) {
-	decks, err := client.Decks.GetAll()
+// returns the deck, url and note model of a url file line, which consists of these whitespace separated fields.
+// The model is optional and may contain spaces, e.g. `Go::bytes https://pkg.go.dev/bytes Golang Cloze`, 
+// it is empty if the line has two fields only. The url has to be an absolute http(s) url.
+func ParseUrlLine(line string) (deck, link, model string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", "", "", fmt.Errorf("expected '<deck> <url> [<model>]', got %d fields", len(fields))
+	}
+	deck, link, model = fields[0], fields[1], strings.Join(fields[2:], " ")
+	u, err := url.Parse(link)
 	if err != nil {
-		log.Fatal("NoteUploader::DeckRequestFailed::", err)
+		return "", "", "", fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", "", fmt.Errorf("expected an absolute http(s) url, got '%s'", link)
 	}
+	return deck, link, model, nil
+}
+
+// download HTML source, found at the tasks url, for any given task instance.
+// Sources found in `cache` aren't downloaded again, downloaded sources are added to `cache`.
+// With `cfg.ParseOnDownload` the source is replaced by its parsed tree, without `cache` pages are parsed while downloading.
+// Tasks failed by a previous stage are passed on unchanged.
+func HtmlDownloader(ctx context.Context, cfg Config, client *http.Client, cache *HtmlCache, out chan<-Task, in <-chan Task) {
 	for task := range in {
-		if !slices.Contains(*decks, task.deck) {
-			err := client.Decks.Create(task.deck)
+		if task.err != nil {
+			if !Send(ctx, out, task) {
+				return
+			}
+			continue
+		}
+		if src, ok := cache.Get(task.url); ok {
+			task.html = src
+			slog.Info("loaded documentation from cache", "url", task.url, "bytes", len(task.html))
+		} else if cfg.ParseOnDownload && cache == nil {
+			root, err := DownloadTree(ctx, cfg, client, task.url)
+			if err != nil {
+				task.err = fmt.Errorf("HtmlDownloader::%v: %w", task, err)
+			} else {
+				task.root = root
+				slog.Info("downloaded and parsed documentation", "url", task.url)
+			}
+		} else {
+			src, err := Download(ctx, cfg, client, task.url)
 			if err != nil {
-				log.Fatal("NoteUploader::DeckCreationFailed::", err)
+				task.err = fmt.Errorf("HtmlDownloader::%v: %w", task, err)
+			} else {
+				task.html = src
+				slog.Info("downloaded documentation", "url", task.url, "bytes", len(task.html))
+				if err := cache.Put(task.url, task.html); err != nil {
+					slog.Warn("caching documentation failed", "url", task.url, "err", err)
+				}
 			}
-			log.Printf("'%s' created deck\n", task.deck)
 		}
-		if len(task.notes) == 0 {
-			log.Printf("%#v contains no cards!\n", task.deck)
+		if cfg.ParseOnDownload && task.html != nil {
+			if root, err := html.Parse(bytes.NewReader(task.html)); err != nil {
+				task.err = fmt.Errorf("HtmlDownloader::%v: %w", task, err)
+			} else {
+				task.root = root
+			}
+			task.html = nil
 		}
-		i := 0
-		Outer: for i < len(task.notes) {
-			note := task.notes[i]
-			err := client.Notes.Add(note)
-			// handle response code
-			switch {
-				case err == nil || err.StatusCode == 200:
-				case err.StatusCode == 500:
-					time.Sleep(100 * time.Millisecond)
-					continue Outer
-				default: 
-					s, _ := json.MarshalIndent(note, "", "\t")
-					log.Fatalf("NoteUploader::UploadFailed:: %v \n Note: \n %v\n", err, string(s))
+		if ctx.Err() != nil || !Send(ctx, out, task) {
+			return
+		}
+	}
+}
+
+// downloads the body at `url`, see DownloadFunc.
+func Download(ctx context.Context, cfg Config, client *http.Client, url string) ([]byte, error) {
+	var body []byte
+	err := DownloadFunc(ctx, cfg, client, url, func(r io.Reader) (err error) {
+		body, err = io.ReadAll(r)
+		return err
+	})
+	return body, err
+}
+
+// downloads the page at `url` and parses it while reading the response, so its source isn't held in memory.
+// See DownloadFunc.
+func DownloadTree(ctx context.Context, cfg Config, client *http.Client, url string) (*html.Node, error) {
+	var root *html.Node
+	err := DownloadFunc(ctx, cfg, client, url, func(r io.Reader) (err error) {
+		root, err = html.Parse(r)
+		return err
+	})
+	return root, err
+}
+
+// downloads the body at `url`, passing it decoded to `read`. Responses with status 429 or 5xx are retried up to `cfg.DownloadRetries` times,
+// waiting for the delay of Backoff or a Retry-After header of 429 responses in between.
+// Each request, retries included, waits for `cfg.Limiter` first. Stops waiting once `ctx` is cancelled.
+func DownloadFunc(ctx context.Context, cfg Config, client *http.Client, url string, read func(body io.Reader) error) error {
+	for retries := 0; ; retries++ {
+		if cfg.Limiter != nil {
+			if err := cfg.Limiter.Wait(ctx); err != nil {
+				return err
 			}
-			i++
 		}
-		log.Printf("'%s' added %d notes to anki\n", task.deck, len(task.notes))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("invalid request: %w", err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		req.Header.Set("User-Agent", cfg.UserAgent)
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to download html: %w", err)
+		}
+
+		// handle response code
+		switch {
+			case resp.StatusCode == 200:
+			case resp.StatusCode == 429 || resp.StatusCode >= 500:
+				resp.Body.Close()
+				if retries < cfg.DownloadRetries {
+					delay := Backoff(cfg.RetryDelay, retries)
+					if wait, ok := RetryAfter(resp.Header.Get("Retry-After")); ok && resp.StatusCode == 429 {
+						delay = min(wait, maxRetryDelay)
+					}
+					if !Sleep(ctx, delay) {
+						return ctx.Err()
+					}
+					continue
+				}
+				return fmt.Errorf("giving up after %d retries: %s", retries, resp.Status)
+			default: 
+				resp.Body.Close()
+				return fmt.Errorf("unexpected response: %s", resp.Status)
+		}
+
+		body, err := DecodeBody(resp)
+		if err == nil {
+			err = read(body)
+			body.Close()
+		}
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read html body: %w", err)
+		}
+		return nil
+	}
+}
+
+// encodings of response bodies ReadBody decodes, requested explicitly, 
+// as the transport decodes gzip only if it requested it itself, which proxies may ignore.
+const acceptEncoding = "gzip, deflate"
+
+// reads the body of `resp`, decoding it according to its Content-Encoding header.
+func ReadBody(resp *http.Response) ([]byte, error) {
+	body, err := DecodeBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// returns a reader decoding the body of `resp` according to its Content-Encoding header.
+// Deflate bodies are accepted zlib wrapped, as the standard demands, and raw, as some servers send them.
+// Closing the reader doesn't close the body.
+func DecodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		return r, nil
+	case "deflate":
+		br := bufio.NewReader(resp.Body)
+		// a zlib header is a multiple of 31 and declares the deflate method
+		if header, err := br.Peek(2); err == nil && header[0] & 0x0f == 8 && (uint16(header[0]) << 8 | uint16(header[1])) % 31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding '%s'", encoding)
 	}
 }
 
+// returns the delay before retry number `retry`: `base` doubled on each retry, capped at `maxRetryDelay`.
+// A random jitter of up to half the delay is subtracted, so competing workers don't retry in lockstep.
+func Backoff(base time.Duration, retry int) time.Duration {
+	delay := maxRetryDelay
+	if retry < 32 && base << retry < maxRetryDelay && base << retry > 0 {
+		delay = base << retry
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2) + 1))
+}
 
+// parses the value of a Retry-After header, given either in seconds or as HTTP date.
+func RetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// parse a tasks HTML source and add a Anki note to the task for each constant block, variable block, function block, type block and method block found
+// Source files linked from the documentation are downloaded using `client`, identified by `cfg.UserAgent`.
+// Tasks failed by a previous stage are passed on unchanged.
+func HtmlProcessor(ctx context.Context, cfg Config, client *http.Client, out chan<- Task, in <-chan Task) {
+	for task := range in {
+		if ctx.Err() != nil {
+			return
+		}
+		// failed tasks are passed on to the final stage, which reports them
+		if task.err != nil {
+			if !Send(ctx, out, task) {
+				return
+			}
+			continue
+		}
+		task.settings = cfg.CardSettings
+		if err := task.Process(NewSourceFetcher(ctx, client, cfg.UserAgent)); err != nil {
+			task.err = err
+		}
+		if !Send(ctx, out, task) {
+			return
+		}
+	}
+}
+
+// extracts the notes of the pkg.go.dev page `t.root`, or `t.html` if it wasn't parsed yet, and adds them to the task.
+// The page is dropped afterwards, only the notes are passed on. Fails for error pages, e.g. of a mistyped or moved package.
+// Implementations are downloaded by `sources`, a nil `sources` leaves them empty.
+func (t *Task) Process(sources *SourceFetcher) error {
+	s := t.settings
+	root := t.root
+	if root == nil {
+		var err error
+		root, err = html.Parse(bytes.NewBuffer(t.html))
+		if err != nil {
+			return fmt.Errorf("HTMLProcessor::root::%w", err)
+		}
+	}
+	t.root, t.html = nil, nil
+
+	// pkg.go.dev answers unknown packages with an error page and status 200
+	if msg := HTMLTrees.FindFirst(root, s.Profile.NotFound); msg != nil {
+		return fmt.Errorf("HTMLProcessor::page not found: %s", HTMLTrees.TextContent(msg))
+	}
+	
+	// local hrefs to global hrefs
+	
+	base, err := s.HrefBase(t.url)
+	if err != nil {
+		return fmt.Errorf("HTMLProcessor::invalid task url: %w", err)
+	}
+	if err := HTMLTrees.ResolveHrefs(root, base); err != nil {
+		return fmt.Errorf("HTMLProcessor::failed to resolve hrefs of %v: %w", t, err)
+	}
+	return t.extract(root, sources)
+}
+
+// returns the url hrefs of the page at `taskUrl` are resolved against.
+// With -base-url, the scheme and host of `taskUrl` are replaced by those of the base url
+// and its path is prefixed by the base url's path, e.g. http://localhost:6060 turns /pkg/bytes/ into http://localhost:6060/pkg/bytes/.
+func (s CardSettings) HrefBase(taskUrl string) (*url.URL, error) {
+	u, err := url.Parse(taskUrl)
+	if err != nil {
+		return nil, err
+	}
+	if s.BaseUrl == nil {
+		return u, nil
+	}
+	res := *s.BaseUrl
+	res.Path = strings.TrimSuffix(s.BaseUrl.Path, "/") + "/" + strings.TrimPrefix(u.Path, "/")
+	res.RawPath = ""
+	res.RawQuery = u.RawQuery
+	res.Fragment = ""
+	return &res, nil
+}
+
+// extracts the notes of the pkg.go.dev page `root` for the package `importPath` into the deck `deck`.
+// Hrefs of `root` aren't resolved and identifiers in `root` get qualified in place.
+// Doesn't access the network, so implementations are left empty.
+func ExtractNotes(root *html.Node, importPath, deck string) ([]ankiconnect.Note, error) {
+	task := NewTask("", deck, defaultModel)
+	task.importPath = importPath
+	if err := task.extract(root, nil); err != nil {
+		return nil, err
+	}
+	return task.notes, nil
+}
+
+// adds a note to the task for each constant block, variable block, function block, type block, struct field 
+// and method block found in `root`. Implementations are downloaded by `sources`, a nil `sources` leaves them empty.
+func (t *Task) extract(root *html.Node, sources *SourceFetcher) error {
+	s := t.settings
+	// whitespace between blocks would separate the siblings walked below
+	HTMLTrees.TrimWhitespaceNodes(root)
+
+	doc_src_add_prefix := func(root *html.Node, name string) error {
+		nodes := s.Profile.SourceLink.Select(root)
+		if len(nodes) == 0 {
+			return fmt.Errorf("HTMLProcessor::doc_src_add_prefix::no source link found in '%s'", HTMLTrees.TextContent(root))
+		}
+		for _, node := range nodes {
+			node.FirstChild.Data = name + "." + node.FirstChild.Data
+			slog.Debug("qualified source link", "deck", t.deck, "name", node.FirstChild.Data)
+		}
+		return nil
+	}
+
+	// source code behind the source link in `header`, empty if not available
+	implementation := func(header *html.Node) string {
+		anchor := HTMLTrees.FindFirst(header, s.Profile.SourceLink)
+		if anchor == nil {
+			return ""
+		}
+		href := AttrOr(anchor, "href", "")
+		if href == "" {
+			return ""
+		}
+		code, err := sources.Declaration(href)
+		if err != nil {
+			slog.Debug("no implementation", "deck", t.deck, "source", href, "err", err)
+			return ""
+		}
+		if code == "" {
+			return ""
+		}
+		return s.GoCodeBlock(code)
+	}
+
+	// part of a function, type or method block shown on the back, the declaration only with -no-doc
+	backNode := func(block *html.Node) *html.Node {
+		if s.NoDoc {
+			if decl := HTMLTrees.FindFirst(block, s.Profile.Declaration); decl != nil {
+				return decl
+			}
+		}
+		return block
+	}
+
+	// front of a function, type or method block, the plain text of its header with -plain-front
+	frontOf := func(header *html.Node) (string, error) {
+		if s.PlainFront {
+			return s.PlainText(header), nil
+		}
+		return s.HeaderHTML(root, header)
+	}
+
+	if s.Mode == modeCloze {
+		return t.extractCloze(root, implementation)
+	}
+
+	// overview
+
+	overview := HTMLTrees.FindFirst(root, s.Profile.Overview)
+	if overview != nil && HasContent(overview) && s.AddedSince == nil && !s.NoDoc {
+		back, err := s.CardHTML(root, overview)
+		if err != nil {
+			return err
+		}
+		t.AddNote("package " + t.ImportPath(), back, "")
+	}
+
+	// variables
+
+	variables := s.Profile.Variables.Select(root)
+	slog.Debug("found variables", "deck", t.deck, "count", len(variables))
+	if err := t.addValueBlocks(root, variables, s.Profile.VariableIds, "variable", s.SplitVarBlocks); err != nil {
+		return err
+	}
+
+	// constants
+
+	constants := s.Profile.Constants.Select(root)
+	slog.Debug("found constants", "deck", t.deck, "count", len(constants))
+	if err := t.addValueBlocks(root, constants, s.Profile.ConstantIds, "constant", s.SplitConstBlocks); err != nil {
+		return err
+	}
+
+	// functions
+
+	functions := t.headedBlocks(root, s.Profile.Functions, s.Profile.FunctionHeaders)
+	slog.Debug("found functions", "deck", t.deck, "count", len(functions))
+
+	for _, block := range functions {
+		function, header := block.body, block.header
+		if id := AttrOr(header, "id", ""); id != "" && !s.Included(id) || !s.IncludedSince(header) {
+			continue
+		}
+		if err := doc_src_add_prefix(header, t.PackageName()); err != nil {
+			return err
+		}
+
+		back, err := s.CardHTML(root, backNode(function))
+		if err != nil {
+			return err
+		}
+		front, err := frontOf(header)
+		if err != nil {
+			return err
+		}
+		tags := s.DeprecationTags(header, function)
+		t.AddNote(front, back, implementation(header), tags...)
+		if s.Reverse {
+			if err := t.addReverse(root, block, front, tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	// types
+
+	types := t.headedBlocks(root, s.Profile.Types, s.Profile.TypeHeaders)
+	slog.Debug("found types", "deck", t.deck, "count", len(types))
+
+	for _, block := range types {
+		type_, header := block.body, block.header
+		if id := AttrOr(header, "id", ""); id != "" && !s.Included(id) || !s.IncludedSince(header) {
+			continue
+		}
+		if err := doc_src_add_prefix(header, t.PackageName()); err != nil {
+			return err
+		}
+		back, err := s.CardHTML(root, backNode(type_))
+		if err != nil {
+			return err
+		}
+		front, err := frontOf(header)
+		if err != nil {
+			return err
+		}
+		tags := s.DeprecationTags(header, type_)
+		t.AddNote(front, back, implementation(header), tags...)
+		if s.Reverse {
+			if err := t.addReverse(root, block, front, tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	// struct fields
+
+	field_count := 0
+	for _, block := range types {
+		if s.AddedSince != nil { // fields carry no version
+			break
+		}
+		decl := HTMLTrees.FindFirst(block.body, s.Profile.Declaration)
+		if decl == nil {
+			continue
+		}
+		for _, field := range StructFields(decl) {
+			// field ids have the form `<type>.<field>`
+			_, name, _ := strings.Cut(field.Id, ".")
+			if !token.IsExported(name) {
+				continue
+			}
+			front := html.EscapeString(t.PackageName() + "." + field.Id)
+			back := s.GoCodeBlock(field.Declaration)
+			var tags []string
+			if strings.Contains(field.Declaration, "Deprecated:") {
+				tags = append(tags, deprecatedTag)
+			}
+			t.AddNote(front, back, "", tags...)
+			field_count++
+		}
+	}
+
+	// methods
+
+	methods := t.headedBlocks(root, s.Profile.Methods, s.Profile.MethodHeaders)
+	slog.Debug("found methods", "deck", t.deck, "count", len(methods))
+
+	for _, block := range methods {
+		method, header := block.body, block.header
+
+		// header ids have the form `<receiver>.<method>`
+		id, err := GetHtmlAttributeByKey(header, "id")
+		if err != nil {
+			return fmt.Errorf("HTMLProcessor::method_header_id::%w", err)
+		}
+		if !s.Included(id.Val) || !s.IncludedSince(header) {
+			continue
+		}
+		receiver, _, _ := strings.Cut(id.Val, ".")
+		if err := doc_src_add_prefix(header, t.PackageName() + "." + receiver); err != nil {
+			return err
+		}
+
+		back, err := s.CardHTML(root, backNode(method))
+		if err != nil {
+			return err
+		}
+		front, err := frontOf(header)
+		if err != nil {
+			return err
+		}
+		tags := s.DeprecationTags(header, method)
+		t.AddNote(front, back, implementation(header), tags...)
+		if s.Reverse {
+			if err := t.addReverse(root, block, front, tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	// examples
+
+	example_count := 0
+	for _, example := range HTMLTrees.FindAll(root, s.Profile.Examples) {
+		if s.AddedSince != nil { // examples carry no version
+			break
+		}
+		front, back, ok := t.exampleCard(example)
+		if !ok {
+			continue
+		}
+		t.AddNote(front, back, "", exampleTag)
+		example_count++
+	}
+
+	slog.Info("generated notes", "deck", t.deck, "url", t.url, 
+		"variables", len(variables), "constants", len(constants), "functions", len(functions), "types", len(types), 
+		"fields", field_count, "methods", len(methods), "examples", example_count, "notes", len(t.notes), "duplicates", t.duplicates,
+	)
+	return nil
+}
+
+// adds a note to the task for each variable or constant block of `blocks`, as named by `kind`, showing the block and its documentation paragraphs.
+// The identifiers selected by `ids` within a block are qualified by the package name. `split` adds a note per line of a block instead, see addSplitBlock.
+func (t *Task) addValueBlocks(root *html.Node, blocks []*html.Node, ids *css.Selector, kind string, split bool) error {
+	s := t.settings
+	for _, block := range blocks {
+		// prefix the declared names with the package name
+		names := make([]string, 0)
+		for _, span := range ids.Select(block) {
+			id, err := GetHtmlAttributeByKey(span, "id")
+			if err != nil {
+				return fmt.Errorf("HTMLProcessor::span_id::%w", err)
+			}
+			names = append(names, id.Val)
+			QualifyIdentifier(span, id.Val, t.PackageName())
+		}
+
+		if !s.Included(names...) || s.AddedSince != nil { // -added-since: declaration blocks carry no version
+			continue
+		}
+
+		// find following <p>...</p>
+		nodes := []*html.Node{block}
+		for c := block.NextSibling; c != nil && c.Data == "p" && !s.NoDoc; c = c.NextSibling {
+			nodes = append(nodes, c)
+		}
+
+		if split {
+			done, err := t.addSplitBlock(root, block, nodes[1:], kind)
+			if err != nil {
+				return err
+			}
+			if done {
+				continue
+			}
+		}
+
+		front, err := s.CardHTML(root, nodes...)
+		if err != nil {
+			return err
+		}
+		t.AddNote(front, front, "", s.DeprecationTags(nodes...)...)
+	}
+	return nil
+}
+
+// adds a cloze note to the task for each function block and method block found in `root`, which hides
+// the receiver, parameters and results of the signature. Implementations are returned by `implementation`.
+func (t *Task) extractCloze(root *html.Node, implementation func(header *html.Node) string) error {
+	s := t.settings
+	blocks := t.headedBlocks(root, s.Profile.Functions, s.Profile.FunctionHeaders)
+	blocks = append(blocks, t.headedBlocks(root, s.Profile.Methods, s.Profile.MethodHeaders)...)
+	for _, block := range blocks {
+		id, err := GetHtmlAttributeByKey(block.header, "id")
+		if err != nil {
+			return fmt.Errorf("HTMLProcessor::cloze_header_id::%w", err)
+		}
+		if !s.Included(id.Val) || !s.IncludedSince(block.header) {
+			continue
+		}
+		decl := HTMLTrees.FindFirst(block.body, s.Profile.Declaration)
+		if decl == nil {
+			slog.Warn("no declaration", "deck", t.deck, "id", id.Val)
+			continue
+		}
+		signature, err := ClozeSignature(CodeText(decl), t.PackageName())
+		if err != nil {
+			slog.Warn("no cloze", "deck", t.deck, "id", id.Val, "err", err)
+			continue
+		}
+		if signature == "" {
+			continue
+		}
+		back, err := s.CardHTML(root, block.body)
+		if err != nil {
+			return err
+		}
+		t.AddNote(s.CodeBlock(signature), back, implementation(block.header), s.DeprecationTags(block.header, block.body)...)
+	}
+	slog.Info("generated cloze notes", "deck", t.deck, "url", t.url, "blocks", len(blocks), "notes", len(t.notes), "duplicates", t.duplicates)
+	return nil
+}
+
+// tag of reverse notes
+const reverseTag = "reverse"
+
+// placeholder of the identifier on the front of reverse notes
+const reverseMask = "…"
+
+// words of a text, words equal to the declared name are masked on reverse notes.
+var wordPattern = regexp.MustCompile(`\w+`)
+
+// adds a reverse note of `block` to the task, which shows the block's documentation on the front and
+// `identifier`, the front of the block's note, on the back. The header of the block is left out and 
+// the declared name is masked in the remaining text, so the front doesn't give the answer away.
+// Skipped if another note of the task has the same front already, which Anki would reject as duplicate.
+func (t *Task) addReverse(root *html.Node, block headedBlock, identifier string, tags []string) error {
+	s := t.settings
+	id := AttrOr(block.header, "id", "")
+	if id == "" {
+		return nil
+	}
+	// ids of methods have the form `<receiver>.<method>`
+	name := id[strings.LastIndex(id, ".") + 1:]
+	mask := func(word string) string {
+		if word == name {
+			return reverseMask
+		}
+		return word
+	}
+
+	cpy := HTMLTrees.DeepCopySubtrees(root, []*html.Node{block.body})
+	err := HTMLTrees.Modify(cpy, func(node *html.Node) error {
+		if node.Type != html.ElementNode {
+			return nil
+		}
+		for c := node.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == html.ElementNode && AttrOr(c, "id", "") == id {
+				HTMLTrees.RemoveNode(c)
+			} else if c.Type == html.TextNode {
+				c.Data = wordPattern.ReplaceAllStringFunc(c.Data, mask)
+			}
+			c = next
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("HTMLProcessor::reverse::%w", err)
+	}
+	front, err := s.renderCard(cpy)
+	if err != nil {
+		return err
+	}
+	for _, note := range t.notes {
+		if note.Fields[s.FieldMap.Front] == front {
+			return nil
+		}
+	}
+	t.AddNote(front, identifier, "", append(slices.Clone(tags), reverseTag)...)
+	return nil
+}
+
+// tag of example notes
+const exampleTag = "example"
+
+// returns the front and back of a card for the runnable example `example`.
+// The front names the documented symbol, which is derived from the example's id `example-<symbol>[-<suffix>]`,
+// together with the example's title suffix, e.g. "Example strings.Fields (Custom)".
+// The back holds the example's code followed by its expected output.
+// Reports false for examples without code or of symbols excluded by -exported-only.
+func (t *Task) exampleCard(example *html.Node) (front, back string, ok bool) {
+	s := t.settings
+	code := HTMLTrees.FindFirst(example, s.Profile.ExampleCode)
+	if code == nil {
+		return "", "", false
+	}
+	symbol := t.ImportPath()
+	if id := AttrOr(example, "id", ""); id != "" {
+		name, _, _ := strings.Cut(strings.TrimPrefix(id, "example-"), "-")
+		if name != "" && name != "package" {
+			if !s.Included(name) {
+				return "", "", false
+			}
+			symbol = t.PackageName() + "." + name
+		}
+	}
+	front = "Example " + symbol
+	if title := HTMLTrees.FindFirst(example, s.Profile.ExampleTitle); title != nil {
+		// titles have the form `Example (<suffix>) ¶`
+		text := strings.TrimSuffix(strings.TrimSpace(HTMLTrees.TextContent(title)), "¶")
+		if _, suffix, found := strings.Cut(text, "("); found {
+			front += " (" + strings.TrimSpace(suffix)
+		}
+	}
+	back = s.GoCodeBlock(CodeText(code))
+	if output := HTMLTrees.FindFirst(example, s.Profile.ExampleOutput); output != nil {
+		back += "<p>Output:</p>" + s.CodeBlock(CodeText(output))
+	}
+	return html.EscapeString(front), back, true
+}
+
+// a declaration block together with its header
+type headedBlock struct {
+	header *html.Node
+	body *html.Node
+}
+
+// returns the blocks of `root` matched by `blocks`, each paired with the first node of its subtree matched by `header`.
+// Blocks without a header are skipped with a warning, so a layout quirk costs single cards instead of the whole page.
+func (t *Task) headedBlocks(root *html.Node, blocks, header *css.Selector) []headedBlock {
+	res := make([]headedBlock, 0)
+	for _, block := range HTMLTrees.FindAll(root, blocks) {
+		h := HTMLTrees.FindFirst(block, header)
+		if h == nil {
+			slog.Warn("skipped a block without header", "deck", t.deck, "package", t.ImportPath())
+			continue
+		}
+		res = append(res, headedBlock{header: h, body: block})
+	}
+	return res
+}
+
+// extracts the notes of the pkg.go.dev page `src` served at `url` for the deck `deck` according to `settings`.
+// Doesn't access the network, so implementations are left empty.
+func ProcessHtml(settings CardSettings, src []byte, url, deck string) ([]ankiconnect.Note, error) {
+	task := NewTask(url, deck, defaultModel)
+	task.settings = settings
+	task.html = src
+	if err := task.Process(nil); err != nil {
+		return nil, err
+	}
+	return task.notes, nil
+}
+
+// attributes kept on the card HTML, all others only style pkg.go.dev
+var cardAttributes = []string{"href", "style"}
+
+// renders a copy of the subtrees `nodes` of `root` as card HTML, stripped of pkg.go.dev's classes, ids and wrapper divs.
+// Code blocks are styled inline if enabled by -inline-style, declarations are highlighted if enabled by -highlight.
+func (s CardSettings) CardHTML(root *html.Node, nodes ...*html.Node) (string, error) {
+	return s.renderCard(HTMLTrees.DeepCopySubtrees(root, nodes))
+}
+
+// renders the copied tree `cpy` as card HTML, modifying it in place.
+func (s CardSettings) renderCard(cpy *html.Node) (string, error) {
+	if s.Highlight {
+		for _, pre := range HTMLTrees.FindAll(cpy, s.Profile.Declaration) {
+			HighlightCodeNode(pre)
+		}
+	}
+	if s.InlineStyle {
+		InlineCodeStyle(cpy)
+	}
+	HTMLTrees.StripAttributes(cpy, cardAttributes...)
+	res, err := HTMLTrees.HTMLString(cpy)
+	if err != nil {
+		return "", fmt.Errorf("HTMLProcessor::render::%w", err)
+	}
+	return res, nil
+}
+
+// renders a copy of the header `header` of `root` as card HTML without the link to the header (¶).
+// The source link around the declared name is replaced by its text, the source code is kept in the implementation field.
+func (s CardSettings) HeaderHTML(root *html.Node, header *html.Node) (string, error) {
+	cpy := HTMLTrees.DeepCopySubtrees(root, []*html.Node{header})
+	for _, anchor := range HTMLTrees.FindAll(cpy, s.Profile.HeaderLink) {
+		HTMLTrees.RemoveNode(anchor)
+	}
+	for _, anchor := range HTMLTrees.FindAll(cpy, s.Profile.SourceLink) {
+		HTMLTrees.Unwrap(anchor)
+	}
+	HTMLTrees.NormalizeText(cpy)
+	return s.renderCard(cpy)
+}
+
+// returns the text of the header `header` escaped for a note field, without the link to the header (¶),
+// its version annotation and its deprecation badge, e.g. `func strings.Fields`.
+func (s CardSettings) PlainText(header *html.Node) string {
+	omit := HTMLTrees.FindAll(header, s.Profile.HeaderLink)
+	omit = append(omit, HTMLTrees.FindAll(header, s.Profile.SinceVersion)...)
+	omit = append(omit, HTMLTrees.FindAll(header, s.Profile.DeprecatedBadge)...)
+	cpy := HTMLTrees.DeepCopyFunc(header, func(node *html.Node) bool {
+		return !slices.Contains(omit, node)
+	})
+	return html.EscapeString(HTMLTrees.TextContent(cpy))
+}
+
+// qualifies the identifier `id` by `pkg` in the text of `span`, e.g. MaxRune -> utf8.MaxRune.
+// Only whole identifiers are replaced, so `E` leaves `Exp` and `ErrE` untouched.
+func QualifyIdentifier(span *html.Node, id, pkg string) {
+	pattern := regexp.MustCompile(`\b(?P<id>` + regexp.QuoteMeta(id) + `)\b`)
+	for _, node := range HTMLTrees.MatchingNodes(span, pattern) {
+		node.Data = pattern.ReplaceAllString(node.Data, pkg + ".${id}")
+	}
+}
+
+// returns the `deprecated` tag, if a paragraph among `nodes` or their direct children starts with the "Deprecated:" marker
+// or a `h4` header among `nodes` carries the profile's deprecation badge.
+func (s CardSettings) DeprecationTags(nodes ...*html.Node) []string {
+	for _, node := range nodes {
+		if node.Data == "h4" && len(s.Profile.DeprecatedBadge.Select(node)) > 0 {
+			return []string{deprecatedTag}
+		}
+		paragraphs := []*html.Node{node}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			paragraphs = append(paragraphs, c)
+		}
+		for _, p := range paragraphs {
+			if p.Type == html.ElementNode && p.Data == "p" && len(HTMLTrees.SelectByText(p, deprecatedPattern)) > 0 {
+				return []string{deprecatedTag}
+			}
+		}
+	}
+	return nil
+}
+
+// reports whether the symbol of `header` was added in the Go version set by -added-since or later,
+// according to the profile's version annotation of `header`, e.g. `added in go1.20`.
+// Symbols without annotation are reported as not recent. Without -added-since all symbols are reported.
+func (s CardSettings) IncludedSince(header *html.Node) bool {
+	if s.AddedSince == nil {
+		return true
+	}
+	badge := HTMLTrees.FindFirst(header, s.Profile.SinceVersion)
+	if badge == nil {
+		return false
+	}
+	version, err := ParseGoVersion(HTMLTrees.TextContent(badge))
+	if err != nil {
+		return false
+	}
+	return CompareGoVersions(version, s.AddedSince) >= 0
+}
+
+// returns the numbers of the Go version in `s`, e.g. `1.22`, `go1.22.1` or `added in go1.20`.
+func ParseGoVersion(s string) ([]int, error) {
+	match := goVersionPattern.FindString(s)
+	if match == "" {
+		return nil, fmt.Errorf("no Go version in '%s'", s)
+	}
+	res := make([]int, 0, 3)
+	for _, part := range strings.Split(match, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// compares the Go versions `a` and `b` as returned by ParseGoVersion, missing numbers count as 0, i.e. 1.22 == 1.22.0.
+// Returns -1, 0 or +1 like slices.Compare.
+func CompareGoVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// reports whether cards for a declaration of the identifiers `ids` are generated. 
+// With -exported-only, at least one identifier has to be exported.
+// Identifiers of the form `<type>.<name>` are exported, if both parts are exported.
+func (s CardSettings) Included(ids ...string) bool {
+	if !s.ExportedOnly || len(ids) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		exported := true
+		for _, part := range strings.Split(id, ".") {
+			exported = exported && token.IsExported(part)
+		}
+		if exported {
+			return true
+		}
+	}
+	return false
+}
+
+// an identifier declared on a line of a declaration, e.g. a field of a struct or a constant of a const block
+type LineDeclaration struct {
+	Id string // e.g. `<type>.<field>` of fields
+	Declaration string // the identifier's line, preceded by its doc comment
+}
+
+// returns the fields of the struct declaration `pre`, which pkg.go.dev marks by `span[data-kind='field']` elements.
+func StructFields(pre *html.Node) []LineDeclaration {
+	return LineDeclarations(pre, "field")
+}
+
+// returns the identifiers declared in `pre`, which pkg.go.dev marks by `span[data-kind='<kind>']` elements.
+// The declaration of an identifier is the plain text of its line together with the comment lines directly above it.
+func LineDeclarations(pre *html.Node, kind string) []LineDeclaration {
+	// split the text into lines, remembering the line of each identifier span
+	lines := []string{""}
+	ids := make(map[int][]string)
+	var rec func(node *html.Node)
+	rec = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			parts := strings.Split(node.Data, "\n")
+			lines[len(lines)-1] += parts[0]
+			lines = append(lines, parts[1:]...)
+			return
+		}
+		if node.Type == html.ElementNode && node.Data == "span" {
+			if AttrOr(node, "data-kind", "") == kind {
+				if id := AttrOr(node, "id", ""); id != "" {
+					ids[len(lines)-1] = append(ids[len(lines)-1], id)
+				}
+			}
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			rec(c)
+		}
+	}
+	rec(pre)
+
+	res := make([]LineDeclaration, 0)
+	for i := range lines {
+		start := i
+		for start > 0 && strings.HasPrefix(strings.TrimSpace(lines[start-1]), "//") {
+			start--
+		}
+		doc := make([]string, 0, i-start+1)
+		for _, l := range lines[start:i+1] {
+			doc = append(doc, strings.TrimSpace(l))
+		}
+		for _, id := range ids[i] {
+			res = append(res, LineDeclaration{
+				Id: id,
+				Declaration: strings.Join(doc, "\n"),
+			})
+		}
+	}
+	return res
+}
+
+// adds a note to the task for each identifier of kind `kind` declared in the declaration block `block`,
+// e.g. each constant of a const block. The front holds the qualified identifier, the back its line
+// followed by `paragraphs`, the documentation shared by the block. Reports whether `block` declares such identifiers.
+func (t *Task) addSplitBlock(root, block *html.Node, paragraphs []*html.Node, kind string) (bool, error) {
+	s := t.settings
+	decls := LineDeclarations(block, kind)
+	if len(decls) == 0 {
+		return false, nil
+	}
+	shared := s.DeprecationTags(paragraphs...)
+	for _, decl := range decls {
+		if !s.Included(decl.Id) {
+			continue
+		}
+		// copy of the block and its documentation, whose declaration is reduced to the identifier's line
+		cpy := HTMLTrees.DeepCopySubtrees(root, append([]*html.Node{block}, paragraphs...))
+		if pre := HTMLTrees.FindFirst(cpy, preSelector); pre != nil {
+			for pre.FirstChild != nil {
+				pre.RemoveChild(pre.FirstChild)
+			}
+			pre.AppendChild(&html.Node{Type: html.TextNode, Data: decl.Declaration})
+		}
+		front := html.EscapeString(t.PackageName() + "." + decl.Id)
+		tags := slices.Clone(shared)
+		if len(tags) == 0 && strings.Contains(decl.Declaration, "Deprecated:") {
+			tags = append(tags, deprecatedTag)
+		}
+		back, err := s.renderCard(cpy)
+		if err != nil {
+			return true, err
+		}
+		t.AddNote(front, back, "", tags...)
+	}
+	return true, nil
+}
+
+// reports whether `node` has an element child besides its heading, i.e. whether a section is not empty.
+func HasContent(node *html.Node) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && !slices.Contains([]string{"h2", "h3", "h4"}, c.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the first attribute of `node` fullfilling `f`, pointing into `node.Attr`, so changes to it apply to `node`.
+func GetHtmlAttribute(node *html.Node, f func(attr html.Attribute) bool) (*html.Attribute, error) {
+	for i := range node.Attr {
+		if f(node.Attr[i]) {
+			return &node.Attr[i], nil
+		}
+	}
+	return nil, errors.New("no matching attribute found")
+}
+
+func GetHtmlAttributeByKey(node *html.Node, key string) (*html.Attribute, error) {
+	return GetHtmlAttribute(node, func(attr html.Attribute) bool {
+		return attr.Key == key
+	})
+}
+
+// returns the value of `node`'s attribute `key` or `def` if `node` has no such attribute.
+func AttrOr(node *html.Node, key, def string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return def
+}
+
+// for each task ensure the associated Anki deck exists and upload all Anki notes from `task` to the specified deck.
+// `decks` holds the decks existing in Anki before the upload, created decks are added to it. Tasks, whose deck can't be created, fail.
+// Returns the summary of the upload, once `in` is closed.
+// Stops between two notes if `ctx` is cancelled. Tasks without rejected notes are recorded in `checkpoint`.
+func NoteUploader(ctx context.Context, cfg Config, client AnkiApi, decks DeckSet, checkpoint *Checkpoint, in <-chan Task) (summary Summary) {
+	for task := range in {
+		summary.Decks++
+		if task.err != nil {
+			slog.Warn("skipped failed task", "deck", task.deck, "url", task.url, "err", task.err)
+			summary.Fail(task)
+			continue
+		}
+		if len(task.notes) == 0 && cfg.SkipEmpty {
+			slog.Info("skipped task without notes", "deck", task.deck, "url", task.url)
+			summary.Empty++
+			if err := checkpoint.Record(task.deck, task.url); err != nil {
+				slog.Warn("recording the checkpoint failed", "deck", task.deck, "url", task.url, "err", err)
+			}
+			continue
+		}
+		if !decks.Contains(task.deck) {
+			err := client.CreateDeck(task.deck)
+			if err != nil {
+				slog.Error("creating the deck failed", "deck", task.deck, "url", task.url, "err", err)
+				summary.Fail(task)
+				continue
+			}
+			decks.Add(task.deck)
+			slog.Info("created deck", "deck", task.deck)
+		}
+		if len(task.notes) == 0 {
+			slog.Warn("task contains no notes", "deck", task.deck, "url", task.url)
+		}
+		notes, duplicates, err := FilterNewNotes(client, task.notes)
+		if err != nil {
+			slog.Warn("duplicate check failed, uploading all notes", "deck", task.deck, "err", err)
+		} else if duplicates > 0 {
+			slog.Info("skipped duplicate notes", "deck", task.deck, "duplicates", duplicates)
+			summary.Duplicates += duplicates
+		}
+
+		// upload all notes at once, notes rejected in the batch are uploaded one by one
+		added, err := client.AddNotes(notes)
+		if err != nil {
+			slog.Warn("batch upload failed, uploading notes one by one", "deck", task.deck, "err", err)
+		}
+		pending := make([]ankiconnect.Note, 0)
+		for j, note := range notes {
+			if !added[j] {
+				pending = append(pending, note)
+			}
+		}
+		if err == nil && len(pending) > 0 {
+			slog.Info("notes rejected in batch, retrying one by one", "deck", task.deck, "rejected", len(pending), "notes", len(notes))
+		}
+		uploaded := len(notes) - len(pending)
+		rejected := 0
+
+		i, retries := 0, 0
+		Outer: for i < len(pending) {
+			if ctx.Err() != nil {
+				slog.Warn("upload interrupted", "deck", task.deck, "added", uploaded, "notes", len(notes))
+				summary.Added += uploaded
+				summary.Rejected += rejected
+				return
+			}
+			note := pending[i]
+			err := client.AddNote(note)
+			// handle response code
+			switch {
+				case err == nil || err.StatusCode == 200:
+					uploaded++
+				case err.StatusCode == 500 && retries < cfg.UploadRetries:
+					Sleep(ctx, Backoff(cfg.UploadRetryDelay, retries))
+					retries++
+					continue Outer
+				case strings.Contains(err.Message, "duplicate"):
+					slog.Info("skipped duplicate note", "deck", task.deck, "front", note.Fields[cfg.FieldMap.Front])
+					summary.Duplicates++
+				default: 
+					s, _ := json.Marshal(note)
+					slog.Error("upload failed", "deck", task.deck, "err", err.Message, "retries", retries, "note", string(s))
+					rejected++
+			}
+			i++
+			retries = 0
+		}
+		slog.Info("added notes", "deck", task.deck, "added", uploaded, "notes", len(notes))
+		summary.Added += uploaded
+		summary.Rejected += rejected
+		if rejected == 0 {
+			if err := checkpoint.Record(task.deck, task.url); err != nil {
+				slog.Warn("recording the checkpoint failed", "deck", task.deck, "url", task.url, "err", err)
+			}
+		}
+	}
+	return
+}
+
+// for each task print all Anki notes from `task` to `w` instead of uploading them.
+// Returns the summary of the printed notes, once `in` is closed.
+func NotePrinter(ctx context.Context, cfg Config, w io.Writer, in <-chan Task) (summary Summary) {
+	for task := range in {
+		if ctx.Err() != nil {
+			return
+		}
+		summary.Decks++
+		if task.err != nil {
+			slog.Warn("skipped failed task", "deck", task.deck, "url", task.url, "err", task.err)
+			summary.Fail(task)
+			continue
+		}
+		for i, note := range task.notes {
+			fmt.Fprintf(w, "==================== %s (%d/%d) %s\n", note.DeckName, i+1, len(task.notes), strings.Join(note.Tags, " "))
+			fmt.Fprintf(w, "-------------------- front\n%s\n", note.Fields[cfg.FieldMap.Front])
+			fmt.Fprintf(w, "-------------------- back\n%s\n", note.Fields[cfg.FieldMap.Back])
+			if impl := note.Fields[cfg.FieldMap.Impl]; impl != "" {
+				fmt.Fprintf(w, "-------------------- implementation\n%s\n", impl)
+			}
+		}
+		summary.Added += len(task.notes)
+		slog.Info("printed notes", "deck", task.deck, "notes", len(task.notes))
+	}
+	return
+}
@@ -0,0 +1,2061 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/ericchiang/css"
+	"golang.org/x/net/html"
+
+	HTMLTrees "gostdlibintoankicards/pkg"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// runs ProcessHtml on the saved pages in testdata and compares the notes with the golden files next to them.
+func TestProcessHtmlGolden(t *testing.T) {
+	cases := []struct{
+		page string
+		url string
+		deck string
+		notes int
+	}{
+		{"bytes", "https://pkg.go.dev/bytes@go1.22.0", "GoLang::StdLib@1.22.0::bytes", 10},
+		{"net_http", "https://pkg.go.dev/net/http@go1.22.0", "GoLang::StdLib@1.22.0::net::http", 13},
+		{"strings", "https://pkg.go.dev/strings@go1.22.0", "GoLang::StdLib@1.22.0::strings", 6},
+	}
+	for _, c := range cases {
+		t.Run(c.page, func(t *testing.T) {
+			src, err := os.ReadFile(filepath.Join("testdata", c.page + ".html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			notes, err := ProcessHtml(DefaultCardSettings(), src, c.url, c.deck)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(notes) != c.notes {
+				t.Errorf("expected %d notes, got %d", c.notes, len(notes))
+			}
+			task := Task{url: c.url, notes: notes}
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "\t")
+			if err := enc.Encode(task.JsonNotes(defaultFieldMap)); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.Bytes()
+			golden := filepath.Join("testdata", c.page + ".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatalf("notes differ from %s, rerun with -update and review the diff\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestProcessHtmlNotFound(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "not_found.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(DefaultCardSettings(), src, "https://pkg.go.dev/bytez@go1.22.0", "GoLang::StdLib@1.22.0::bytez")
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Fatalf("expected a not found error, got %v with %d notes", err, len(notes))
+	}
+}
+
+// the strings page renders an example as a headerless block between the function blocks,
+// each card has to combine a header with the documentation of its own block nevertheless.
+func TestProcessHtmlInterleavedExample(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "strings.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(DefaultCardSettings(), src, "https://pkg.go.dev/strings@go1.22.0", "Go::strings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"Contains", "Fields", "Join"}
+	notes = slices.DeleteFunc(notes, func(note ankiconnect.Note) bool {
+		return !strings.Contains(note.Fields[defaultFieldMap.Front], "func ")
+	})
+	if len(notes) != len(names) {
+		t.Fatalf("expected %d function notes, got %d", len(names), len(notes))
+	}
+	for i, note := range notes {
+		if !strings.Contains(note.Fields[defaultFieldMap.Front], "strings." + names[i] + " ") {
+			t.Errorf("note %d: expected the header of %s, got %s", i, names[i], note.Fields[defaultFieldMap.Front])
+		}
+		if !strings.Contains(note.Fields[defaultFieldMap.Back], "<p>" + names[i] + " ") {
+			t.Errorf("note %d: expected the documentation of %s, got %s", i, names[i], note.Fields[defaultFieldMap.Back])
+		}
+	}
+}
+
+func TestExtractNotes(t *testing.T) {
+	cases := []struct{
+		name string
+		src string
+		fronts []string // text of the note fronts
+		err bool
+	}{
+		{
+			name: "function",
+			src: `<div class="Documentation-function"><h4 id="Fields" class="Documentation-functionHeader">func <a class="Documentation-source" href="#">Fields</a></h4><p>Fields splits s.</p></div>`,
+			fronts: []string{"func strings.Fields"},
+		},
+		{
+			name: "unexported method",
+			src: `<div class="Documentation-type"><h4 id="Builder" class="Documentation-typeHeader">type <a class="Documentation-source" href="#">Builder</a></h4>` +
+				`<div class="Documentation-typeMethod"><h4 id="Builder.grow" class="Documentation-typeMethodHeader">func (*Builder) <a class="Documentation-source" href="#">grow</a></h4></div></div>`,
+			fronts: []string{"type strings.Builder"},
+		},
+		{
+			name: "constant",
+			src: `<section class="Documentation-constants"><div class="Documentation-declaration"><pre>const <span id="MaxRune" data-kind="constant">MaxRune</span> = '\U0010FFFF'</pre></div><p>Maximum rune.</p></section>`,
+			fronts: []string{"const strings.MaxRune = '\\U0010FFFF'Maximum rune."},
+		},
+		{
+			name: "header without source link",
+			src: `<div class="Documentation-function"><h4 id="Fields" class="Documentation-functionHeader">func Fields</h4></div>`,
+			err: true,
+		},
+		{
+			name: "function without header",
+			src: `<div class="Documentation-function"><p>Fields splits s.</p></div>` +
+				`<div class="Documentation-function"><h4 id="Join" class="Documentation-functionHeader">func <a class="Documentation-source" href="#">Join</a></h4><p>Join concatenates elems.</p></div>`,
+			fronts: []string{"func strings.Join"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			notes, err := ExtractNotes(root, "strings", "Go::strings")
+			if c.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			fronts := make([]string, 0, len(notes))
+			for _, note := range notes {
+				if note.DeckName != "Go::strings" {
+					t.Fatalf("unexpected deck '%s'", note.DeckName)
+				}
+				root, err := html.Parse(strings.NewReader(note.Fields[defaultFieldMap.Front]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				fronts = append(fronts, HTMLTrees.TextContent(root))
+			}
+			if !slices.Equal(fronts, c.fronts) {
+				t.Fatalf("expected fronts %q, got %q", c.fronts, fronts)
+			}
+		})
+	}
+}
+
+// returns a task for `deck` with a note for each of `fronts`.
+func uploadTask(deck string, fronts ...string) Task {
+	task := NewTask("https://pkg.go.dev/" + deck, deck, defaultModel)
+	for _, front := range fronts {
+		task.AddNote(front, "back of " + front, "")
+	}
+	return task
+}
+
+// runs NoteUploader configured by `cfg` on `tasks` and returns its summary and the checkpoint file it wrote.
+// The decks existing before the upload are requested from `client` like by main.
+func runUploader(t *testing.T, cfg Config, client AnkiApi, tasks ...Task) (Summary, string) {
+	all, restErr := client.GetDecks()
+	if restErr != nil {
+		t.Fatal(restErr.Message)
+	}
+	fp := filepath.Join(t.TempDir(), "checkpoint.txt")
+	checkpoint, err := OpenCheckpoint(fp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan Task, len(tasks))
+	for _, task := range tasks {
+		in <- task
+	}
+	close(in)
+	summary := NoteUploader(context.Background(), cfg, client, NewDeckSet(*all...), checkpoint, in)
+	if err := checkpoint.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return summary, fp
+}
+
+func TestNoteUploaderCreatesDecks(t *testing.T) {
+	anki := &fakeAnki{decks: []string{"Default", "Go::fmt"}}
+	summary, _ := runUploader(t, DefaultConfig(), anki,
+		uploadTask("Go::fmt", "Println", "Printf"),
+		uploadTask("Go::io", "Copy"),
+		uploadTask("Go::io", "Copy", "ReadAll"),
+	)
+	want := Summary{Decks: 3, Added: 4, Duplicates: 1}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+	if want := []string{"Default", "Go::fmt", "Go::io"}; !slices.Equal(anki.decks, want) {
+		t.Fatalf("expected decks %v, got %v", want, anki.decks)
+	}
+	if len(anki.notes) != 4 {
+		t.Fatalf("expected 4 notes without duplicates, got %d", len(anki.notes))
+	}
+}
+
+func TestNoteUploaderCreatesDecksOnce(t *testing.T) {
+	anki := &fakeAnki{decks: []string{"Default", "Go::fmt"}}
+	runUploader(t, DefaultConfig(), anki,
+		uploadTask("Go::io", "Copy"),
+		uploadTask("Go::io", "ReadAll"),
+		uploadTask("Go", "Overview"), // parent of the known Go::fmt
+		uploadTask("Go::io::fs", "Glob"),
+		uploadTask("Go::io::fs", "Sub"),
+	)
+	if want := []string{"Go::io", "Go::io::fs"}; !slices.Equal(anki.created, want) {
+		t.Fatalf("expected created decks %v, got %v", want, anki.created)
+	}
+}
+
+func TestNoteUploaderCreateDeckFails(t *testing.T) {
+	anki := &fakeAnki{decks: []string{"Default"}, createFails: "Go::io"}
+	summary, _ := runUploader(t, DefaultConfig(), anki,
+		uploadTask("Go::io", "Copy"),
+		uploadTask("Go::fmt", "Println"),
+	)
+	want := Summary{Decks: 2, Added: 1, Errors: 1, FailedUrls: []string{"https://pkg.go.dev/Go::io"}, Failed: []UrlPair{{Deck: "Go::io", Url: "https://pkg.go.dev/Go::io"}}}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+	if len(anki.notes) != 1 || anki.notes[0].DeckName != "Go::fmt" {
+		t.Fatalf("expected only the notes of Go::fmt, got %v", anki.notes)
+	}
+}
+
+func TestNoteUploaderSkipsEmptyTasks(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SkipEmpty = true
+	anki := &fakeAnki{decks: []string{"Default"}}
+	summary, _ := runUploader(t, cfg, anki, uploadTask("Go::unsafe"), uploadTask("Go::io", "Copy"))
+	want := Summary{Decks: 2, Added: 1, Empty: 1}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+	if want := []string{"Go::io"}; !slices.Equal(anki.created, want) {
+		t.Fatalf("expected created decks %v, got %v", want, anki.created)
+	}
+}
+
+func TestNoteUploaderRetriesServerErrors(t *testing.T) {
+	anki := &fakeAnki{batchFails: true, serverErrors: 2}
+	summary, _ := runUploader(t, DefaultConfig(), anki, uploadTask("Go::fmt", "Println", "Printf"))
+	if summary.Errors != 0 || summary.Added != 2 {
+		t.Fatalf("expected 2 added notes and no errors, got %+v", summary)
+	}
+	if len(anki.notes) != 2 {
+		t.Fatalf("expected 2 notes, got %d", len(anki.notes))
+	}
+	if anki.addCalls != 4 {
+		t.Fatalf("expected 2 retried and 2 successful calls, got %d calls", anki.addCalls)
+	}
+}
+
+func TestNoteUploaderGivesUpOnServerErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UploadRetries, cfg.UploadRetryDelay = 3, time.Millisecond
+
+	anki := &fakeAnki{batchFails: true, serverErrors: 10}
+	summary, _ := runUploader(t, cfg, anki, uploadTask("Go::fmt", "Println", "Printf"))
+	if summary.Rejected != 2 {
+		t.Fatalf("expected 2 rejected notes, got %+v", summary)
+	}
+	// the first note fails 1+3 times, the second one 1+3 times before 2 more errors remain
+	if anki.addCalls != 8 {
+		t.Fatalf("expected 8 calls, got %d", anki.addCalls)
+	}
+	if len(anki.notes) != 0 {
+		t.Fatalf("expected no notes, got %d", len(anki.notes))
+	}
+}
+
+func TestNoteUploaderSkipsDuplicates(t *testing.T) {
+	// duplicates slip through the duplicate check, so AddNote rejects them
+	anki := &fakeAnki{batchFails: true, duplicates: true}
+	task := uploadTask("Go::fmt", "Println", "Printf")
+	// Task.AddNote collapses duplicates, notes of different tasks may still collide
+	task.notes = slices.Insert(task.notes, 1, task.notes[0])
+	summary, fp := runUploader(t, DefaultConfig(), anki, task)
+	if anki.addCalls != 3 || len(anki.notes) != 2 {
+		t.Fatalf("expected 3 calls adding 2 notes, got %d calls adding %d notes", anki.addCalls, len(anki.notes))
+	}
+	if summary.Duplicates != 1 || summary.Rejected != 0 {
+		t.Fatalf("expected 1 duplicate and no rejected notes, got %+v", summary)
+	}
+	checkpoint, err := OpenCheckpoint(fp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	if !checkpoint.Done(task.deck, task.url) {
+		t.Fatal("task with skipped duplicates wasn't recorded")
+	}
+}
+
+func TestNoteUploaderCheckpointsCompleteTasks(t *testing.T) {
+	anki := &fakeAnki{batchFails: true, rejectFront: "Printf"}
+	fmtTask := uploadTask("Go::fmt", "Println", "Printf")
+	ioTask := uploadTask("Go::io", "Copy")
+	errTask := uploadTask("Go::os", "Open")
+	errTask.err = errors.New("download failed")
+	summary, fp := runUploader(t, DefaultConfig(), anki, fmtTask, ioTask, errTask)
+	if summary.Errors != 1 || !slices.Equal(summary.FailedUrls, []string{errTask.url}) {
+		t.Fatalf("expected the errored task to fail, got %+v", summary)
+	}
+	checkpoint, err := OpenCheckpoint(fp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	if checkpoint.Done(fmtTask.deck, fmtTask.url) {
+		t.Fatal("task with a rejected note was recorded")
+	}
+	if !checkpoint.Done(ioTask.deck, ioTask.url) {
+		t.Fatal("complete task wasn't recorded")
+	}
+	if checkpoint.Done(errTask.deck, errTask.url) {
+		t.Fatal("errored task was recorded")
+	}
+}
+
+func TestParseUrlLine(t *testing.T) {
+	cases := []struct{
+		line string
+		deck string
+		url string
+		model string
+		err bool
+	}{
+		{"Go::bytes https://pkg.go.dev/bytes@go1.22.0", "Go::bytes", "https://pkg.go.dev/bytes@go1.22.0", "", false},
+		{"Go::bytes\t  http://localhost:8080/bytes", "Go::bytes", "http://localhost:8080/bytes", "", false},
+		{"Go::bytes", "", "", "", true},
+		{"Go::bytes https://pkg.go.dev/bytes Basic", "Go::bytes", "https://pkg.go.dev/bytes", "Basic", false},
+		{"Go::bytes https://pkg.go.dev/bytes  Golang\tCloze ", "Go::bytes", "https://pkg.go.dev/bytes", "Golang Cloze", false},
+		{"Go::bytes pkg.go.dev/bytes", "", "", "", true},
+		{"Go::bytes ftp://pkg.go.dev/bytes", "", "", "", true},
+		{"Go::bytes https://pkg.go.dev/%zz", "", "", "", true},
+	}
+	for _, c := range cases {
+		deck, url, model, err := ParseUrlLine(c.line)
+		if (err != nil) != c.err {
+			t.Fatalf("'%s': expected error %v, got %v", c.line, c.err, err)
+		}
+		if deck != c.deck || url != c.url || model != c.model {
+			t.Fatalf("'%s': expected (%s, %s, %s), got (%s, %s, %s)", c.line, c.deck, c.url, c.model, deck, url, model)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	pairs, err := ParseArgs([]string{
+		"Go::bytes", "https://pkg.go.dev/bytes",
+		"Go::io=https://pkg.go.dev/io?tab=doc",
+		"Go::fmt", "https://pkg.go.dev/fmt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UrlPair{
+		{Deck: "Go::bytes", Url: "https://pkg.go.dev/bytes"},
+		{Deck: "Go::io", Url: "https://pkg.go.dev/io?tab=doc"},
+		{Deck: "Go::fmt", Url: "https://pkg.go.dev/fmt"},
+	}
+	if !slices.Equal(pairs, want) {
+		t.Fatalf("expected %v, got %v", want, pairs)
+	}
+
+	for _, args := range [][]string{
+		{"Go::bytes"},
+		{"Go::bytes", "Go::io"},
+		{"Go::bytes=pkg.go.dev/bytes"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestUrlPairModels(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "urls.txt")
+	lines := "Go::bytes https://pkg.go.dev/bytes\nGo::strings https://pkg.go.dev/strings Golang Cloze\nGo::io https://pkg.go.dev/io Basic\nGo::os https://pkg.go.dev/os Basic\n"
+	if err := os.WriteFile(fp, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := ReadUrlFile(fp, true)
+	if err != nil || len(pairs) != 4 || pairs[1].Model != "Golang Cloze" {
+		t.Fatalf("unexpected pairs %v %v", pairs, err)
+	}
+	if got, want := UrlPairModels(pairs, defaultModel), []string{defaultModel, "Golang Cloze", "Basic"}; !slices.Equal(got, want) {
+		t.Fatalf("expected the models %v, got %v", want, got)
+	}
+}
+
+func TestReadUrlFile(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "urls.txt")
+	lines := "# comment\n\nGo::bytes https://pkg.go.dev/bytes\nmalformed\nGo::io https://pkg.go.dev/io\n"
+	if err := os.WriteFile(fp, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := ReadUrlFile(fp, false)
+	if err != nil || len(pairs) != 2 || pairs[1].Deck != "Go::io" {
+		t.Fatalf("expected the malformed line to be skipped, got %v %v", pairs, err)
+	}
+	if _, err := ReadUrlFile(fp, true); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("expected an error naming the malformed line, got %v", err)
+	}
+	if _, err := ReadUrlFile(filepath.Join(dir, "missing.txt"), false); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+	// lines longer than the buffer of the scanner fail the read
+	long := "Go::bytes https://pkg.go.dev/" + strings.Repeat("a", bufio.MaxScanTokenSize) + "\n"
+	if err := os.WriteFile(fp, []byte(long), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadUrlFile(fp, false); err == nil {
+		t.Fatal("expected an error for a line exceeding the scanner's buffer")
+	}
+}
+
+func TestHrefBase(t *testing.T) {
+	cases := []struct{
+		base string
+		page string
+		href string
+		want string
+	}{
+		{"", "https://pkg.go.dev/bytes@go1.22.0", "#Buffer", "https://pkg.go.dev/bytes@go1.22.0#Buffer"},
+		{"http://localhost:6060", "https://pkg.go.dev/pkg/bytes/", "/pkg/io/#Reader", "http://localhost:6060/pkg/io/#Reader"},
+		{"http://localhost:6060", "http://127.0.0.1:8080/pkg/bytes/", "#Buffer", "http://localhost:6060/pkg/bytes/#Buffer"},
+		{"http://localhost:6060/", "http://127.0.0.1:8080/pkg/bytes/", "../io/", "http://localhost:6060/pkg/io/"},
+		{"https://docs.example.com/go", "http://127.0.0.1:8080/pkg/bytes/", "#Buffer", "https://docs.example.com/go/pkg/bytes/#Buffer"},
+	}
+	for _, c := range cases {
+		settings := DefaultCardSettings()
+		if c.base != "" {
+			settings.BaseUrl, _ = url.Parse(c.base)
+		}
+		base, err := settings.HrefBase(c.page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		href, _ := url.Parse(c.href)
+		if got := base.ResolveReference(href).String(); got != c.want {
+			t.Fatalf("'%s' on '%s' with base '%s': expected %s, got %s", c.href, c.page, c.base, c.want, got)
+		}
+	}
+}
+
+func TestClozeSignature(t *testing.T) {
+	cases := []struct{
+		decl string
+		want string
+	}{
+		{"func Clone(b []byte) []byte", "func bytes.Clone({{c1::b []byte}}) {{c2::[]byte}}"},
+		{"func (b *Buffer) Write(p []byte) (n int, err error)", "func ({{c1::b *Buffer}}) bytes.Buffer.Write({{c2::p []byte}}) {{c3::(n int, err error)}}"},
+		{"func (l *List[T]) Len() int", "func ({{c1::l *List[T]}}) bytes.List.Len() {{c2::int}}"},
+		{"func Map[S ~[]E, E any](s S,\n\tf func(E) E) S", "func bytes.Map[S ~[]E, E any]({{c1::s S,\n\tf func(E) E}}) {{c2::S}}"},
+		{"func Init()", ""},
+		// braces of hidden text don't end the deletion early
+		{"func (c *Ctx) Done() <-chan struct{}", "func ({{c1::c *Ctx}}) bytes.Ctx.Done() {{c2::<-chan struct{} }}"},
+		{"func Print(v interface{})", "func bytes.Print({{c1::v interface{} }})"},
+		{"func Ready() func() struct{}", "func bytes.Ready() {{c1::func() struct{} }}"},
+		{"func Nest(m map[string]struct{ V interface{}})", "func bytes.Nest({{c1::m map[string]struct{ V interface{} } }})"},
+	}
+	for _, c := range cases {
+		got, err := ClozeSignature(c.decl, "bytes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%q: expected %q, got %q", c.decl, c.want, got)
+		}
+	}
+	if _, err := ClozeSignature("type Buffer struct{}", "bytes"); err == nil {
+		t.Fatal("expected an error for a type declaration")
+	}
+}
+
+func TestProcessHtmlCloze(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.Mode = modeCloze
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/bytes@go1.22.0", "Go::bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"<pre><code>func bytes.Clone({{c1::b []byte}}) {{c2::[]byte}}</code></pre>",
+		"<pre><code>func bytes.Compare({{c1::a, b []byte}}) {{c2::int}}</code></pre>",
+		"<pre><code>func bytes.Title({{c1::s []byte}}) {{c2::[]byte}}</code></pre>",
+		"<pre><code>func ({{c1::b *Buffer}}) bytes.Buffer.Len() {{c2::int}}</code></pre>",
+		"<pre><code>func ({{c1::b *Buffer}}) bytes.Buffer.Write({{c2::p []byte}}) {{c3::(n int, err error)}}</code></pre>",
+	}
+	fronts := make([]string, 0, len(notes))
+	for _, note := range notes {
+		fronts = append(fronts, note.Fields[defaultFieldMap.Front])
+	}
+	if !slices.Equal(fronts, want) {
+		t.Fatalf("expected fronts\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(fronts, "\n"))
+	}
+}
+
+func TestProcessHtmlReverse(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.Reverse = true
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/bytes@go1.22.0", "Go::bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := func(field string) string {
+		root, err := html.Parse(strings.NewReader(field))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return HTMLTrees.TextContent(root)
+	}
+	names := make([]string, 0)
+	for _, note := range notes {
+		if !slices.Contains(note.Tags, reverseTag) {
+			continue
+		}
+		// the back holds the qualified identifier, e.g. `func bytes.Clone added in go1.20` -> Clone
+		var name string
+		for _, field := range strings.Fields(text(note.Fields[defaultFieldMap.Back])) {
+			if strings.HasPrefix(field, "bytes.") {
+				name = field[strings.LastIndex(field, ".") + 1:]
+			}
+		}
+		names = append(names, name)
+		front := text(note.Fields[defaultFieldMap.Front])
+		if regexp.MustCompile(`\b` + name + `\b`).MatchString(front) {
+			t.Errorf("reverse front of %s gives the name away: %s", name, front)
+		}
+		if !strings.Contains(front, reverseMask) {
+			t.Errorf("reverse front of %s lacks the mask: %s", name, front)
+		}
+	}
+	want := []string{"Clone", "Compare", "Title", "Buffer", "Len", "Write"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("expected reverse notes of %v, got %v", want, names)
+	}
+}
+
+func TestQualifyIdentifier(t *testing.T) {
+	cases := []struct{
+		src string
+		id string
+		want string
+	}{
+		{`<span>E</span>`, "E", "math.E"},
+		{`<span>E <!-- E --><b>E</b></span>`, "E", "math.E math.E"},
+		{`<span>Exp(E) ErrE E_ E</span>`, "E", "Exp(math.E) ErrE E_ math.E"},
+		{`<span>Pi2 Pi</span>`, "Pi", "Pi2 math.Pi"},
+	}
+	for _, c := range cases {
+		root, err := html.Parse(strings.NewReader(c.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		span := HTMLTrees.FindFirst(root, css.MustParse("span"))
+		QualifyIdentifier(span, c.id, "math")
+		if got := HTMLTrees.TextContent(span); got != c.want {
+			t.Errorf("%s: expected '%s', got '%s'", c.src, c.want, got)
+		}
+	}
+}
+
+func TestProcessHtmlSplitConstBlocks(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.SplitConstBlocks = true
+	src, err := os.ReadFile(filepath.Join("testdata", "net_http.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/net/http@go1.22.0", "Go::net::http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backs := make(map[string]string)
+	for _, note := range notes {
+		backs[note.Fields[defaultFieldMap.Front]] = note.Fields[defaultFieldMap.Back]
+	}
+	want := map[string]string{
+		"http.MethodGet": `<pre>http.MethodGet     = &#34;GET&#34;</pre><p>Common HTTP methods.</p>`,
+		"http.MethodPost": `<pre>http.MethodPost    = &#34;POST&#34;</pre><p>Common HTTP methods.</p>`,
+		"http.DefaultMaxHeaderBytes": `<pre>const http.DefaultMaxHeaderBytes = 1 &lt;&lt; 20 // 1 MB</pre><p>DefaultMaxHeaderBytes is`,
+	}
+	for front, back := range want {
+		got, ok := backs[front]
+		if !ok {
+			t.Fatalf("no note of %s", front)
+		}
+		if !strings.Contains(got, back) {
+			t.Errorf("%s: expected the back to contain %s, got %s", front, back, got)
+		}
+	}
+	for front := range backs {
+		if strings.Contains(front, "MethodHead") && front != "http.MethodHead" {
+			t.Errorf("unexpected note of the whole const block: %s", front)
+		}
+	}
+}
+
+// failed tasks have to pass the download and process stages unchanged, so the final stage reports them
+func TestStagesSkipFailedTasks(t *testing.T) {
+	failed := NewTask("http://127.0.0.1:0/bytes", "Go::bytes", defaultModel)
+	failed.err = errors.New("download failed")
+	stages := map[string]func(context.Context, chan<- Task, <-chan Task){
+		"HtmlDownloader": func(ctx context.Context, out chan<- Task, in <-chan Task) {
+			HtmlDownloader(ctx, DefaultConfig(), http.DefaultClient, nil, out, in)
+		},
+		"HtmlProcessor": func(ctx context.Context, out chan<- Task, in <-chan Task) {
+			HtmlProcessor(ctx, DefaultConfig(), http.DefaultClient, out, in)
+		},
+	}
+	for name, stage := range stages {
+		in := make(chan Task, 1)
+		out := make(chan Task, 1)
+		in <- failed
+		close(in)
+		stage(context.Background(), out, in)
+		task := <-out
+		if task.err != failed.err || len(task.notes) != 0 || task.html != nil {
+			t.Errorf("%s: expected the failed task unchanged, got %v", name, task)
+		}
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+	cfg := DefaultConfig()
+	cfg.Rate = 20
+	cfg.Limiter = cfg.NewLimiter()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := Download(context.Background(), cfg, server.Client(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first request passes immediately, the others wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90 * time.Millisecond {
+		t.Fatalf("expected the downloads to take at least 100ms at 20 requests/s, took %v", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	cases := []struct{
+		retry int
+		delay time.Duration // delay before the jitter
+	}{
+		{0, base},
+		{1, 2 * base},
+		{3, 8 * base},
+		{9, maxRetryDelay}, // 51.2s exceeds the cap
+		{40, maxRetryDelay}, // the shift overflows
+		{70, maxRetryDelay},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			if got := Backoff(base, c.retry); got < c.delay / 2 || got > c.delay {
+				t.Fatalf("retry %d: expected a delay between %v and %v, got %v", c.retry, c.delay / 2, c.delay, got)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct{
+		value string
+		min, max time.Duration
+		ok bool
+	}{
+		{"", 0, 0, false},
+		{"0", 0, 0, true},
+		{"120", 120 * time.Second, 120 * time.Second, true},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute, true},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, 0, true}, // dates in the past don't wait
+		{"-5", 0, 0, false},
+		{"soon", 0, 0, false},
+		{"1.5", 0, 0, false},
+	}
+	for _, c := range cases {
+		got, ok := RetryAfter(c.value)
+		if ok != c.ok || got < c.min || got > c.max {
+			t.Errorf("RetryAfter(%q): expected a delay between %v and %v and %v, got %v and %v", c.value, c.min, c.max, c.ok, got, ok)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	progress := NewProgress()
+	if got := progress.String(); got != "0/? downloaded, 0/? processed, 0/? finished" {
+		t.Fatalf("unexpected progress '%s'", got)
+	}
+	pairs := []UrlPair{{Deck: "Go::bytes", Url: "https://pkg.go.dev/bytes"}, {Deck: "Go::io", Url: "https://pkg.go.dev/io"}}
+	generated := make(chan Task)
+	downloaded := make(chan Task)
+	go TaskGenerator(context.Background(), DefaultConfig(), pairs, nil, progress, generated)
+	go progress.Relay(context.Background(), stageDownloaded, downloaded, generated)
+	for range downloaded {
+	}
+	if got := progress.String(); got != "2/2 downloaded, 0/2 processed, 0/2 finished" {
+		t.Fatalf("unexpected progress '%s'", got)
+	}
+}
+
+func TestProcessHtmlAddedSince(t *testing.T) {
+	cases := []struct{
+		page string
+		url string
+		since string
+		fronts []string
+	}{
+		{"bytes", "https://pkg.go.dev/bytes@go1.22.0", "1.20", []string{"func bytes.Clone added in go1.20"}},
+		{"bytes", "https://pkg.go.dev/bytes@go1.22.0", "go1.21", nil},
+		{"net_http", "https://pkg.go.dev/net/http@go1.22.0", "1.18.0", []string{"func (*Cookie) http.Cookie.Valid added in go1.18"}},
+	}
+	for _, c := range cases {
+		version, err := ParseGoVersion(c.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings := DefaultCardSettings()
+		settings.AddedSince = version
+		src, err := os.ReadFile(filepath.Join("testdata", c.page + ".html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		notes, err := ProcessHtml(settings, src, c.url, "Go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fronts []string
+		for _, note := range notes {
+			root, err := html.Parse(strings.NewReader(note.Fields[defaultFieldMap.Front]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fronts = append(fronts, HTMLTrees.TextContent(root))
+		}
+		if !slices.Equal(fronts, c.fronts) {
+			t.Errorf("%s since %s: expected %q, got %q", c.page, c.since, c.fronts, fronts)
+		}
+	}
+}
+
+func TestPrefixDeck(t *testing.T) {
+	cases := []struct{
+		deck, prefix string
+		replace int
+		expected string
+	}{
+		{"GoLang::StdLib::bytes", "", 1, "GoLang::StdLib::bytes"},
+		{"GoLang::StdLib::bytes", "Go", 0, "Go::GoLang::StdLib::bytes"},
+		{"GoLang::StdLib::bytes", "Go::", 0, "Go::GoLang::StdLib::bytes"},
+		{"GoLang::StdLib::bytes", "Go::Lib", 2, "Go::Lib::bytes"},
+		{"GoLang::StdLib::bytes", "Go", 5, "Go::bytes"},
+		{"bytes", "Go", 1, "Go::bytes"},
+	}
+	for _, c := range cases {
+		if got := PrefixDeck(c.deck, c.prefix, c.replace); got != c.expected {
+			t.Errorf("PrefixDeck(%#v, %#v, %d) = %#v, expected %#v", c.deck, c.prefix, c.replace, got, c.expected)
+		}
+	}
+}
+
+func TestTaskGeneratorDeckPrefix(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeckPrefix, cfg.DeckPrefixReplace = "Go", 2
+
+	fp := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(fp, []byte("Go::io https://pkg.go.dev/io\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := OpenCheckpoint(fp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+
+	pairs := []UrlPair{
+		{Deck: "GoLang::StdLib::Net::Http", Url: "https://pkg.go.dev/"},
+		{Deck: "GoLang::StdLib::io", Url: "https://pkg.go.dev/io"},
+	}
+	out := make(chan Task)
+	go TaskGenerator(context.Background(), cfg, pairs, checkpoint, nil, out)
+	tasks := make([]Task, 0)
+	for task := range out {
+		tasks = append(tasks, task)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("expected the io task to be skipped by the checkpoint, got %v", tasks)
+	}
+	if tasks[0].deck != "Go::Net::Http" {
+		t.Errorf("unexpected deck '%s'", tasks[0].deck)
+	}
+	// derived from the original deck, the url has no path
+	if got := tasks[0].ImportPath(); got != "net/http" {
+		t.Errorf("unexpected import path '%s'", got)
+	}
+}
+
+func TestTaskGeneratorLimit(t *testing.T) {
+	pairs := []UrlPair{{Deck: "Go::bytes", Url: "https://pkg.go.dev/bytes"}, {Deck: "Go::io", Url: "https://pkg.go.dev/io"}, {Deck: "Go::os", Url: "https://pkg.go.dev/os"}}
+	for _, c := range []struct{ limit, tasks int }{{0, 3}, {-1, 3}, {2, 2}, {5, 3}} {
+		cfg := DefaultConfig()
+		cfg.TaskLimit = c.limit
+		out := make(chan Task)
+		go TaskGenerator(context.Background(), cfg, pairs, nil, nil, out)
+		count := 0
+		for range out {
+			count++
+		}
+		if count != c.tasks {
+			t.Errorf("-limit %d: expected %d tasks, got %d", c.limit, c.tasks, count)
+		}
+	}
+}
+
+func TestDownloadDecodesBody(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"": nil,
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	}
+	for encoding, encoder := range encoders {
+		t.Run(encoding, func(t *testing.T) {
+			var body bytes.Buffer
+			if encoder == nil {
+				body.Write(src)
+			} else {
+				w := encoder(&body)
+				w.Write(src)
+				w.Close()
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+					t.Errorf("unexpected Accept-Encoding '%s'", r.Header.Get("Accept-Encoding"))
+				}
+				if encoding != "" {
+					w.Header().Set("Content-Encoding", encoding)
+				}
+				w.Write(body.Bytes())
+			}))
+			defer server.Close()
+			html, err := Download(context.Background(), DefaultConfig(), server.Client(), server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(html, src) {
+				t.Fatalf("expected the decoded page, got %d bytes: %.40q", len(html), html)
+			}
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(src)
+	}))
+	defer server.Close()
+	if _, err := Download(context.Background(), DefaultConfig(), server.Client(), server.URL); err == nil {
+		t.Fatal("expected an error for an unsupported encoding")
+	}
+}
+
+func TestDownloadUserAgent(t *testing.T) {
+	cfg := DefaultConfig()
+	if !strings.HasPrefix(cfg.UserAgent, "GoDoc2Anki/") {
+		t.Fatalf("unexpected default User-Agent '%s'", cfg.UserAgent)
+	}
+	cfg.UserAgent = "test-agent/1.0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("User-Agent"); got != cfg.UserAgent {
+			t.Errorf("unexpected User-Agent '%s'", got)
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+	if _, err := Download(context.Background(), cfg, server.Client(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+	level, err := ParseLogLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, level)
+	logger.Info("downloaded documentation", "url", "https://pkg.go.dev/bytes")
+	logger.Warn("no declaration", "deck", "Go::bytes", "id", "Clone")
+	if got, want := buf.String(), `msg="no declaration" deck=Go::bytes id=Clone`; strings.Contains(got, "downloaded") || !strings.Contains(got, want) {
+		t.Fatalf("expected only the warning with %s, got %s", want, got)
+	}
+}
+
+func TestAddNoteCollapsesDuplicates(t *testing.T) {
+	task := NewTask("https://pkg.go.dev/bytes", "Go::bytes", defaultModel)
+	task.AddNote("type bytes.Buffer", "<p>A Buffer is a buffer.</p>", "")
+	task.AddNote("type  bytes.Buffer\n", "<p>A Buffer\n is a buffer.</p>", "", deprecatedTag)
+	task.AddNote("type bytes.Buffer", "<p>A Buffer is a variable-sized buffer.</p>", "")
+	task.AddNote("func bytes.NewBuffer", "<p>A Buffer is a buffer.</p>", "")
+	if len(task.notes) != 3 || task.duplicates != 1 {
+		t.Fatalf("expected 3 notes and 1 duplicate, got %d notes and %d duplicates", len(task.notes), task.duplicates)
+	}
+}
+
+func TestAttrOr(t *testing.T) {
+	node := &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{{Key: "id", Val: "Clone"}, {Key: "class", Val: ""}}}
+	cases := []struct{ key, def, expected string }{
+		{"id", "none", "Clone"},
+		{"class", "none", ""}, // present, but empty
+		{"href", "none", "none"},
+	}
+	for _, c := range cases {
+		if got := AttrOr(node, c.key, c.def); got != c.expected {
+			t.Errorf("AttrOr(%s, %#v) = %#v, expected %#v", c.key, c.def, got, c.expected)
+		}
+	}
+}
+
+func TestGetHtmlAttributeByKey(t *testing.T) {
+	node := &html.Node{Type: html.ElementNode, Data: "a", Attr: []html.Attribute{{Key: "id", Val: "x"}, {Key: "href", Val: "#Clone"}}}
+	href, err := GetHtmlAttributeByKey(node, "href")
+	if err != nil {
+		t.Fatal(err)
+	}
+	href.Val = "https://pkg.go.dev/bytes#Clone"
+	if got := AttrOr(node, "href", ""); got != href.Val {
+		t.Fatalf("expected the change to apply to the node, got href %#v", got)
+	}
+	if _, err := GetHtmlAttributeByKey(node, "class"); err == nil {
+		t.Fatal("expected an error for a missing attribute")
+	}
+}
+
+// canned response of servePage
+type cannedResponse struct {
+	status int
+	retryAfter string // value of the Retry-After header, empty sends none
+}
+
+// a fake pkg.go.dev serving a testdata page, see servePage
+type pageServer struct {
+	*httptest.Server
+	mu sync.Mutex
+	hits map[string]int // requests per path
+}
+
+// returns the number of requests of `path`.
+func (s *pageServer) Hits(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+// serves the page `testdata/<page>.html` at every path. The first requests of a path of `responses` are answered by its canned responses instead,
+// e.g. to test retries. Requests are counted per path, see Hits.
+func servePage(t testing.TB, page string, responses map[string][]cannedResponse) *pageServer {
+	src, err := os.ReadFile(filepath.Join("testdata", page + ".html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &pageServer{hits: make(map[string]int)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		hit := server.hits[r.URL.Path]
+		server.hits[r.URL.Path]++
+		server.mu.Unlock()
+		if canned := responses[r.URL.Path]; hit < len(canned) {
+			if canned[hit].retryAfter != "" {
+				w.Header().Set("Retry-After", canned[hit].retryAfter)
+			}
+			http.Error(w, http.StatusText(canned[hit].status), canned[hit].status)
+			return
+		}
+		w.Write(src)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// downloads and processes the page served by `server` as the page of bytes, returning the processed task.
+// Pages are parsed while downloading them if `parse` is set.
+func downloadAndProcess(t testing.TB, server *pageServer, parse bool) Task {
+	cfg := DefaultConfig()
+	cfg.ParseOnDownload = parse
+	in := make(chan Task, 1)
+	in <- NewTask(server.URL + "/bytes@go1.22.0", "Go::bytes", defaultModel)
+	close(in)
+	downloaded := make(chan Task, 1)
+	HtmlDownloader(context.Background(), cfg, server.Client(), nil, downloaded, in)
+	task := <-downloaded
+	if task.err != nil {
+		t.Fatal(task.err)
+	}
+	if parse != (task.root != nil) || parse == (task.html != nil) {
+		t.Fatalf("expected only the %s of the page to be passed on", map[bool]string{true: "tree", false: "source"}[parse])
+	}
+	if err := task.Process(nil); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestHtmlDownloaderParseOnDownload(t *testing.T) {
+	server := servePage(t, "bytes", nil)
+	for _, parse := range []bool{false, true} {
+		task := downloadAndProcess(t, server, parse)
+		if len(task.notes) != 10 || task.root != nil || task.html != nil {
+			t.Fatalf("-parse-on-download=%v: expected 10 notes and the page to be dropped, got %d notes", parse, len(task.notes))
+		}
+	}
+}
+
+// compares the allocations per page of passing sources and trees, not the memory held by a full queue,
+// run with `go test ./cmd -run none -bench Download -benchmem`
+func BenchmarkDownloadAndProcess(b *testing.B) {
+	server := servePage(b, "net_http", nil)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(NewLogger(io.Discard, slog.LevelError))
+	for _, parse := range []bool{false, true} {
+		b.Run(map[bool]string{false: "source", true: "tree"}[parse], func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				downloadAndProcess(b, server, parse)
+			}
+		})
+	}
+}
+
+// copies of a task are processed concurrently, run with `go test -race`
+func TestProcessConcurrentCopies(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := NewTask("https://pkg.go.dev/bytes@go1.22.0", "Go::bytes", defaultModel)
+	task.html = src
+	task.AddNote("package bytes", "shared note", "")
+	parsed := task.Copy()
+	parsed.root, err = html.Parse(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	copies := make([]Task, 8)
+	errs := make([]error, len(copies))
+	for i := range copies {
+		copies[i] = []Task{task, parsed}[i % 2].Copy()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = copies[i].Process(nil)
+		}(i)
+	}
+	wg.Wait()
+	for i, c := range copies {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if len(c.notes) != 11 {
+			t.Errorf("copy %d: expected 11 notes, got %d", i, len(c.notes))
+		}
+	}
+	if len(task.notes) != 1 || len(parsed.notes) != 1 || parsed.root == nil {
+		t.Fatal("processing the copies changed the original tasks")
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	module, pkg := servePage(t, "x_net", nil), servePage(t, "bytes", nil)
+	found, err := Discover(context.Background(), DefaultConfig(), module.Client(), UrlPair{Deck: "Go::net", Url: module.URL + "/golang.org/x/net@v0.20.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UrlPair{
+		{Deck: "Go::net::bpf", Url: module.URL + "/golang.org/x/net/bpf@v0.20.0"},
+		{Deck: "Go::net::html", Url: module.URL + "/golang.org/x/net/html@v0.20.0"},
+		{Deck: "Go::net::html::atom", Url: module.URL + "/golang.org/x/net/html/atom@v0.20.0"},
+		{Deck: "Go::net::html::charset", Url: module.URL + "/golang.org/x/net/html/charset@v0.20.0"},
+	}
+	if !slices.Equal(found, want) {
+		t.Fatalf("expected %v, got %v", want, found)
+	}
+
+	// package pages list themselves
+	bytesPair := UrlPair{Deck: "Go::bytes", Url: pkg.URL + "/bytes"}
+	found, err = Discover(context.Background(), DefaultConfig(), pkg.Client(), bytesPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(found, []UrlPair{bytesPair}) {
+		t.Fatalf("expected only the package itself, got %v", found)
+	}
+}
+
+func TestTaskGeneratorDiscover(t *testing.T) {
+	module := servePage(t, "x_net", nil)
+	cfg := DefaultConfig()
+	cfg.DiscoverClient = module.Client()
+	pairs := []UrlPair{{Deck: "Go::net", Url: module.URL + "/golang.org/x/net"}, {Deck: "Go::broken", Url: "http://127.0.0.1:0/broken"}}
+	out := make(chan Task)
+	go TaskGenerator(context.Background(), cfg, pairs, nil, nil, out)
+	decks := make([]string, 0)
+	for task := range out {
+		decks = append(decks, task.deck)
+	}
+	// pairs, whose discovery failed, are kept
+	want := []string{"Go::net::bpf", "Go::net::html", "Go::net::html::atom", "Go::net::html::charset", "Go::broken"}
+	if !slices.Equal(decks, want) {
+		t.Fatalf("expected decks %v, got %v", want, decks)
+	}
+}
+
+func TestProcessHtmlNoDoc(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.NoDoc = true
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/bytes@go1.22.0", "Go::bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backs := make(map[string]string)
+	for _, note := range notes {
+		root, err := html.Parse(strings.NewReader(note.Fields[defaultFieldMap.Front]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		front := HTMLTrees.TextContent(root)
+		if strings.HasPrefix(front, "package ") {
+			t.Fatalf("expected no overview note, got %s", front)
+		}
+		backs[front] = note.Fields[defaultFieldMap.Back]
+	}
+	want := map[string]string{
+		"func bytes.Clone added in go1.20": "<pre>func Clone(b []",
+		"type bytes.Buffer": "<pre>type Buffer struct {",
+		"func (*Buffer) bytes.Buffer.Len": "<pre>func (b *",
+	}
+	for front, decl := range want {
+		back, ok := backs[front]
+		if !ok {
+			t.Fatalf("no note of %s in %v", front, backs)
+		}
+		if !strings.Contains(back, decl) || strings.Contains(back, "<p>") || strings.Contains(back, "<h4") {
+			t.Errorf("%s: expected only the declaration on the back, got %s", front, back)
+		}
+	}
+	for front, back := range backs {
+		if strings.Contains(front, "MinRead") && strings.Contains(back, "minimum slice size") {
+			t.Errorf("%s: expected no documentation paragraphs, got %s", front, back)
+		}
+	}
+}
+
+func TestTaskGeneratorModels(t *testing.T) {
+	pairs := []UrlPair{
+		{Deck: "Go::bytes", Url: "https://pkg.go.dev/bytes"},
+		{Deck: "Go::strings", Url: "https://pkg.go.dev/strings", Model: "Golang Cloze"},
+	}
+	cfg := DefaultConfig()
+	cfg.Model = "Basic"
+	out := make(chan Task)
+	go TaskGenerator(context.Background(), cfg, pairs, nil, nil, out)
+	models := make(map[string]string)
+	for task := range out {
+		models[task.deck] = task.model
+		task.AddNote("front", "back", "")
+		if task.notes[0].ModelName != task.model {
+			t.Fatalf("expected notes of model '%s', got '%s'", task.model, task.notes[0].ModelName)
+		}
+	}
+	if want := map[string]string{"Go::bytes": "Basic", "Go::strings": "Golang Cloze"}; !reflect.DeepEqual(models, want) {
+		t.Fatalf("expected models %v, got %v", want, models)
+	}
+}
+
+func TestProcessHtmlPlainFront(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.PlainFront = true
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/bytes@go1.22.0", "Go::bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backs := make(map[string]string)
+	for _, note := range notes {
+		backs[note.Fields[defaultFieldMap.Front]] = note.Fields[defaultFieldMap.Back]
+	}
+	for _, front := range []string{"func bytes.Clone", "type bytes.Buffer", "func (*Buffer) bytes.Buffer.Len"} {
+		back, ok := backs[front]
+		if !ok {
+			t.Fatalf("no note of %s in %v", front, backs)
+		}
+		if !strings.Contains(back, "<pre>") {
+			t.Errorf("%s: expected HTML on the back, got %s", front, back)
+		}
+	}
+}
+
+func TestProcessHtmlFrontsWithoutAnchors(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "net_http.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(DefaultCardSettings(), src, "https://pkg.go.dev/net/http@go1.22.0", "Go::net::http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := 0
+	for _, note := range notes {
+		front := note.Fields[defaultFieldMap.Front]
+		if !strings.Contains(front, "<h4>") {
+			continue
+		}
+		headers++
+		if strings.Contains(front, "<a") || strings.Contains(front, "¶") {
+			t.Errorf("expected a front without anchors, got %s", front)
+		}
+	}
+	if headers == 0 {
+		t.Fatal("expected notes with a header on the front")
+	}
+}
+
+func TestProcessHtmlSplitVarBlocks(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.SplitVarBlocks = true
+	src, err := os.ReadFile(filepath.Join("testdata", "net_http.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/net/http@go1.22.0", "Go::net::http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]ankiconnect.Note)
+	for _, note := range notes {
+		found[note.Fields[defaultFieldMap.Front]] = note
+	}
+	want := map[string]string{
+		"http.ErrNotSupported": "http.ErrNotSupported = &amp;ProtocolError{&#34;feature not supported&#34;}</pre>",
+		"http.ErrUnexpectedTrailer": "// Deprecated: ErrUnexpectedTrailer is no longer returned by",
+	}
+	for front, back := range want {
+		note, ok := found[front]
+		if !ok {
+			t.Fatalf("no note of %s", front)
+		}
+		if got := note.Fields[defaultFieldMap.Back]; !strings.Contains(got, back) {
+			t.Errorf("%s: expected the back to contain %s, got %s", front, back, got)
+		}
+	}
+	if tags := found["http.ErrUnexpectedTrailer"].Tags; !slices.Contains(tags, deprecatedTag) {
+		t.Errorf("expected the deprecated variable to be tagged, got %v", tags)
+	}
+	if tags := found["http.ErrNotSupported"].Tags; slices.Contains(tags, deprecatedTag) {
+		t.Errorf("expected the other variable of the block untagged, got %v", tags)
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	args := []string{"-download-workers", "2", "-max-retries", "0", "-rate", "4", "-model", "Basic", "-field-map", "front=Front,back=Back", "-output", "tsv", "-skip-empty"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.DownloadWorkers, want.DownloadRetries, want.Rate, want.Model = 2, 0, 4, "Basic"
+	want.FieldMap.Front, want.FieldMap.Back = "Front", "Back"
+	want.Output, want.SkipEmpty = outputTsv, true
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("expected %+v, got %+v", want, cfg)
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NewLimiter() == nil || DefaultConfig().NewLimiter() != nil {
+		t.Fatal("expected a limiter only for a positive -rate")
+	}
+
+	invalid := map[string]func(*Config){
+		"workers": func(c *Config) { c.ProcessWorkers = 0 },
+		"retries": func(c *Config) { c.UploadRetries = -1 },
+		"rate": func(c *Config) { c.Rate = -1 },
+		"timeout": func(c *Config) { c.HttpTimeout = 0 },
+		"output": func(c *Config) { c.Output = "csv" },
+		"stdout": func(c *Config) { c.Output, c.OutputFile = outputApkg, "-" },
+	}
+	for name, modify := range invalid {
+		cfg := DefaultConfig()
+		modify(&cfg)
+		if err := cfg.Check(); err == nil {
+			t.Errorf("%s: expected an error for %+v", name, cfg)
+		}
+	}
+}
+
+func TestNewHttpClientCertificates(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	// the rejected handshake is expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	download := func(cfg Config) error {
+		client, err := NewHttpClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Download(context.Background(), cfg, client, server.URL)
+		return err
+	}
+
+	cfg := DefaultConfig()
+	if err := download(cfg); err == nil {
+		t.Fatal("expected an unknown certificate to be rejected")
+	}
+	cfg.CACert = ca
+	if err := download(cfg); err != nil {
+		t.Fatalf("expected the certificate of -ca-cert to be trusted, got %v", err)
+	}
+	cfg = DefaultConfig()
+	cfg.Insecure = true
+	if err := download(cfg); err != nil {
+		t.Fatalf("expected -insecure to skip the verification, got %v", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.CACert = filepath.Join("testdata", "bytes.html")
+	if _, err := NewHttpClient(cfg); err == nil {
+		t.Fatal("expected an error for a file without certificates")
+	}
+}
+
+func TestFailuresRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeckPrefix = "Go"
+	dir := t.TempDir()
+	lines := "GoLang::bytes https://pkg.go.dev/bytes\nGoLang::strings https://pkg.go.dev/strings Golang Cloze\n"
+	urls := filepath.Join(dir, "urls.txt")
+	if err := os.WriteFile(urls, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := ReadUrlFile(urls, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan Task)
+	go TaskGenerator(context.Background(), cfg, pairs, nil, nil, out)
+	var summary Summary
+	for task := range out {
+		if !strings.HasPrefix(task.deck, "Go::GoLang::") {
+			t.Fatalf("expected the deck below -deck-prefix, got %s", task.deck)
+		}
+		task.err = errors.New("download failed")
+		summary.Fail(task)
+	}
+	// local packages of -source-dir can't be rerun by a url file
+	summary.Failed = append(summary.Failed, UrlPair{Deck: "example.com::mod", Url: "file:///src/mod"})
+	failures := filepath.Join(dir, "failures.txt")
+	if written, err := WriteUrlFile(failures, summary.Failed); err != nil || written != 2 {
+		t.Fatalf("expected 2 written pairs, got %d %v", written, err)
+	}
+	got, err := os.ReadFile(failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != lines {
+		t.Fatalf("expected the failures in the format of the url file\n%s\ngot\n%s", lines, got)
+	}
+
+	if _, err := WriteUrlFile(failures, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(failures); err != nil || len(got) != 0 {
+		t.Fatalf("expected an empty failures file, got '%s' %v", got, err)
+	}
+}
+
+func TestTaskGeneratorDeckSep(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeckSep, cfg.DeckPrefix = "/", "Go/Lang"
+	pairs := []UrlPair{
+		{Deck: "StdLib/net/http", Url: "https://pkg.go.dev/net/http"},
+		{Deck: "GoLang/StdLib/net/url", Url: "https://example.com"},
+	}
+	out := make(chan Task)
+	go TaskGenerator(context.Background(), cfg, pairs, nil, nil, out)
+	var tasks []Task
+	for task := range out {
+		tasks = append(tasks, task)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %v", tasks)
+	}
+	want := []struct{ deck, importPath string }{
+		{"Go::Lang::StdLib::net::http", "net/http"},
+		{"Go::Lang::GoLang::StdLib::net::url", "net/url"}, // derived from the deck
+	}
+	for i, task := range tasks {
+		if task.deck != want[i].deck || task.ImportPath() != want[i].importPath {
+			t.Errorf("expected deck %s of %s, got %s of %s", want[i].deck, want[i].importPath, task.deck, task.ImportPath())
+		}
+		if task.Pair() != pairs[i] {
+			t.Errorf("expected the pair %v, got %v", pairs[i], task.Pair())
+		}
+	}
+}
+
+func TestSourceGenerator(t *testing.T) {
+	root := filepath.Join("testdata", "localmod")
+	dirs, err := PackageDirs(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(root, "greet")}; !slices.Equal(dirs, want) {
+		t.Fatalf("expected the packages %v without internal ones, got %v", want, dirs)
+	}
+	importPath, err := SourceImportPath(root, dirs[0])
+	if err != nil || importPath != "example.com/localmod/greet" {
+		t.Fatalf("expected the import path below the module, got '%s' %v", importPath, err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.DeckPrefix = "Go"
+	out := make(chan Task)
+	go SourceGenerator(context.Background(), cfg, root, dirs, nil, nil, out)
+	var tasks []Task
+	for task := range out {
+		tasks = append(tasks, task)
+	}
+	if len(tasks) != 1 || tasks[0].deck != "Go::example.com::localmod::greet" || tasks[0].ImportPath() != "example.com/localmod/greet" {
+		t.Fatalf("expected a task of the greet package, got %v", tasks)
+	}
+	if !strings.HasPrefix(tasks[0].url, "file:///") {
+		t.Fatalf("expected a file url, got %s", tasks[0].url)
+	}
+}
+
+func TestProcessSource(t *testing.T) {
+	task := NewTask("file:///greet", "Go::greet", defaultModel)
+	task.importPath = "example.com/localmod/greet"
+	task.dir = filepath.Join("testdata", "localmod", "greet")
+	if err := task.ProcessSource(); err != nil {
+		t.Fatal(err)
+	}
+	notes := make(map[string]ankiconnect.Note)
+	for _, note := range task.notes {
+		notes[note.Fields[defaultFieldMap.Front]] = note
+	}
+	want := map[string]string{
+		"package example.com/localmod/greet": `<a href="https://pkg.go.dev/strings#Title">strings.Title</a>`,
+		"func greet.Hello": "<pre><code>func Hello(name string) string</code></pre><p>Hello returns the greeting",
+		"func greet.Hi": "Deprecated: Use Hello instead.",
+		"type greet.Greeter": "Greeting string\n\t// contains filtered or unexported fields",
+		"func greet.NewGreeter": "func NewGreeter(greeting string) *Greeter",
+		"func (*Greeter) greet.Greeter.Greet": "func (g *Greeter) Greet(name string) string",
+	}
+	for front, back := range want {
+		note, ok := notes[front]
+		if !ok {
+			t.Fatalf("no note of %s in %v", front, task.notes)
+		}
+		if !strings.Contains(note.Fields[defaultFieldMap.Back], back) {
+			t.Errorf("%s: expected the back to contain %q, got %s", front, back, note.Fields[defaultFieldMap.Back])
+		}
+	}
+	if impl := notes["func greet.Hello"].Fields[defaultFieldMap.Impl]; !strings.Contains(impl, "strings.TrimSpace(name)") {
+		t.Errorf("expected the implementation of Hello, got %s", impl)
+	}
+	if tags := notes["func greet.Hi"].Tags; !slices.Contains(tags, deprecatedTag) {
+		t.Errorf("expected the deprecated function to be tagged, got %v", tags)
+	}
+	blocks := 0
+	for _, note := range task.notes {
+		back := note.Fields[defaultFieldMap.Back]
+		if strings.Contains(back, "helper") || strings.Contains(back, "TestOnly") {
+			t.Errorf("expected no unexported or test symbols, got %s", back)
+		}
+		if strings.Contains(back, "greet.English\t= &#34;Hello&#34;") || strings.Contains(back, "var greet.Default = English") {
+			blocks++
+		}
+	}
+	if len(task.notes) != 8 || blocks != 2 {
+		t.Fatalf("expected 8 notes including a const and a var block, got %d notes and %d blocks", len(task.notes), blocks)
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	code := "func F(s string) int { // <count>\n\treturn len(s) + 1 /* one */\n}"
+	want := `<span style="` + keywordStyle + `">func</span> F(s <span style="` + predeclaredStyle + `">string</span>) <span style="` + predeclaredStyle + `">int</span> { ` +
+		`<span style="` + highlightCommentStyle + `">// &lt;count&gt;</span>` + "\n\t" +
+		`<span style="` + keywordStyle + `">return</span> <span style="` + predeclaredStyle + `">len</span>(s) + <span style="` + numberStyle + `">1</span> ` +
+		`<span style="` + highlightCommentStyle + `">/* one */</span>` + "\n}"
+	if got := HighlightCode(code); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	if got := HighlightCode(`x := "a\"b" + 'c'`); got != `x := <span style="` + stringStyle + `">&#34;a\&#34;b&#34;</span> + <span style="` + stringStyle + `">&#39;c&#39;</span>` {
+		t.Errorf("unexpected highlighting of literals %s", got)
+	}
+}
+
+func TestProcessHtmlHighlight(t *testing.T) {
+	settings := DefaultCardSettings()
+	settings.Highlight = true
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ProcessHtml(settings, src, "https://pkg.go.dev/bytes@go1.22.0", "Go::bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, note := range notes {
+		if !strings.Contains(note.Fields[defaultFieldMap.Front], "bytes.Buffer.Len") {
+			continue
+		}
+		back := note.Fields[defaultFieldMap.Back]
+		for _, want := range []string{`<span style="` + keywordStyle + `">func</span>`, `<span style="` + predeclaredStyle + `">int</span>`, `<a href="https://pkg.go.dev/bytes@go1.22.0#Buffer">Buffer</a>`} {
+			if !strings.Contains(back, want) {
+				t.Errorf("expected the back to contain %s, got %s", want, back)
+			}
+		}
+		return
+	}
+	t.Fatal("no note of Buffer.Len")
+}
+
+func TestInlineCodeStyle(t *testing.T) {
+	src := `<pre>x := 1 <span class="comment">// one</span></pre>` +
+		`<pre style="margin: 0;"><code>y := 2</code></pre>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	InlineCodeStyle(root)
+	pres := HTMLTrees.FindAll(root, preSelector)
+	if len(pres) != 2 {
+		t.Fatalf("expected 2 code blocks, got %d", len(pres))
+	}
+	for i, pre := range pres {
+		code := pre.FirstChild
+		if code == nil || code != pre.LastChild || code.Data != "code" {
+			t.Fatalf("expected the content of block %d to be wrapped into a single <code>", i)
+		}
+	}
+	if got := AttrOr(pres[0], "style", ""); got != codeStyle {
+		t.Errorf("expected the style %q, got %q", codeStyle, got)
+	}
+	if got := AttrOr(pres[1], "style", ""); got != "margin: 0; " + codeStyle {
+		t.Errorf("expected the style to be appended to the existing one, got %q", got)
+	}
+	if got := HTMLTrees.TextContent(pres[1]); got != "y := 2" {
+		t.Errorf("expected the existing <code> to be kept, got %q", got)
+	}
+	span := HTMLTrees.FindFirst(root, commentSelector)
+	if span == nil || span.Parent.Data != "code" || AttrOr(span, "style", "") != commentStyle {
+		t.Fatal("expected the comment to be colored inline inside the <code>")
+	}
+}
+
+func TestSetStyle(t *testing.T) {
+	cases := []struct{
+		attr []html.Attribute
+		want string
+	}{
+		{nil, "color: red;"},
+		{[]html.Attribute{{Key: "class", Val: "x"}}, "color: red;"},
+		{[]html.Attribute{{Key: "style", Val: "margin: 0"}}, "margin: 0; color: red;"},
+		{[]html.Attribute{{Key: "style", Val: " margin: 0; "}}, "margin: 0; color: red;"},
+	}
+	for _, c := range cases {
+		node := &html.Node{Type: html.ElementNode, Data: "span", Attr: c.attr}
+		setStyle(node, "color: red;")
+		if got := AttrOr(node, "style", ""); got != c.want {
+			t.Errorf("expected the style %q for %v, got %q", c.want, c.attr, got)
+		}
+		styles := slices.IndexFunc(node.Attr, func(attr html.Attribute) bool { return attr.Key == "style" })
+		if slices.IndexFunc(node.Attr[styles + 1:], func(attr html.Attribute) bool { return attr.Key == "style" }) >= 0 {
+			t.Errorf("expected a single style attribute, got %v", node.Attr)
+		}
+	}
+}
+
+func TestHtmlDownloaderStatuses(t *testing.T) {
+	cases := []struct{
+		name string
+		responses []cannedResponse
+		retryDelay time.Duration
+		hits int
+		err string // expected part of the error, empty expects the page
+		minElapsed time.Duration
+	}{
+		{"ok", nil, time.Millisecond, 1, "", 0},
+		// the Retry-After header replaces the backoff delay of an hour
+		{"429 with Retry-After", []cannedResponse{{429, "0"}, {429, "0"}}, time.Hour, 3, "", 0},
+		{"500 with backoff", []cannedResponse{{500, ""}}, 40 * time.Millisecond, 2, "", 20 * time.Millisecond},
+		// Retry-After is only honored on 429
+		{"503 with Retry-After", []cannedResponse{{503, "3600"}}, time.Millisecond, 2, "", 0},
+		{"500 until giving up", []cannedResponse{{500, ""}, {500, ""}, {500, ""}}, time.Millisecond, 3, "giving up after 2 retries: 500", 0},
+		{"404 isn't retried", []cannedResponse{{404, ""}}, time.Millisecond, 1, "unexpected response: 404", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := servePage(t, "bytes", map[string][]cannedResponse{"/bytes@go1.22.0": c.responses})
+			cfg := DefaultConfig()
+			cfg.DownloadRetries = 2
+			cfg.RetryDelay = c.retryDelay
+			in := make(chan Task, 1)
+			in <- NewTask(server.URL + "/bytes@go1.22.0", "Go::bytes", defaultModel)
+			close(in)
+			out := make(chan Task, 1)
+			start := time.Now()
+			HtmlDownloader(context.Background(), cfg, server.Client(), nil, out, in)
+			elapsed := time.Since(start)
+			task := <-out
+
+			if hits := server.Hits("/bytes@go1.22.0"); hits != c.hits {
+				t.Errorf("expected %d requests, got %d", c.hits, hits)
+			}
+			if elapsed < c.minElapsed {
+				t.Errorf("expected the retry to wait at least %v, took %v", c.minElapsed, elapsed)
+			}
+			if c.err == "" {
+				if task.err != nil || !bytes.Contains(task.html, []byte("Documentation-function")) {
+					t.Fatalf("expected the page, got error %v", task.err)
+				}
+				return
+			}
+			if task.err == nil || !strings.Contains(task.err.Error(), c.err) || task.html != nil {
+				t.Fatalf("expected an error containing %q, got %v", c.err, task.err)
+			}
+		})
+	}
+}
+
+// a failed download fails its task only, the downloader continues with the next tasks
+func TestHtmlDownloaderFailurePropagation(t *testing.T) {
+	server := servePage(t, "bytes", map[string][]cannedResponse{"/broken": {{500, ""}, {500, ""}}})
+	cfg := DefaultConfig()
+	cfg.DownloadRetries = 1
+	cfg.RetryDelay = time.Millisecond
+	in := make(chan Task, 2)
+	in <- NewTask(server.URL + "/broken", "Go::broken", defaultModel)
+	in <- NewTask(server.URL + "/bytes@go1.22.0", "Go::bytes", defaultModel)
+	close(in)
+	downloaded := make(chan Task, 2)
+	HtmlDownloader(context.Background(), cfg, server.Client(), nil, downloaded, in)
+	close(downloaded)
+
+	tasks := make(map[string]Task)
+	for task := range downloaded {
+		// processed without a client, so no implementations are fetched from the network
+		if task.err == nil {
+			if err := task.Process(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tasks[task.deck] = task
+	}
+	if broken := tasks["Go::broken"]; broken.err == nil || len(broken.notes) != 0 {
+		t.Errorf("expected the broken task to fail without notes, got %v", broken.err)
+	}
+	if ok := tasks["Go::bytes"]; ok.err != nil || len(ok.notes) != 10 {
+		t.Errorf("expected 10 notes of bytes, got %d notes and error %v", len(ok.notes), ok.err)
+	}
+}
+
+func TestJsonWriterCancelled(t *testing.T) {
+	task := NewTask("https://pkg.go.dev/bytes", "Go::bytes", defaultModel)
+	task.AddNote("front", "back", "")
+	for _, cancelled := range []bool{false, true} {
+		in := make(chan Task, 2)
+		in <- task
+		in <- task
+		close(in)
+		ctx, cancel := context.WithCancel(context.Background())
+		if cancelled {
+			cancel()
+		}
+		var buf bytes.Buffer
+		JsonWriter(ctx, DefaultConfig(), &buf, in)
+		cancel()
+		var notes []JsonNote
+		if err := json.Unmarshal(buf.Bytes(), &notes); err != nil {
+			t.Fatalf("cancelled=%v: expected valid JSON, got %v: %s", cancelled, err, buf.String())
+		}
+		if want := map[bool]int{false: 2, true: 0}[cancelled]; len(notes) != want {
+			t.Errorf("cancelled=%v: expected %d notes, got %d", cancelled, want, len(notes))
+		}
+	}
+}
+
+func TestNotePrinter(t *testing.T) {
+	task := NewTask("https://pkg.go.dev/bytes", "Go::bytes", defaultModel)
+	task.AddNote("func bytes.Clone", "<p>Clone</p>", "<pre>func Clone</pre>", "go:1.22")
+	task.AddNote("type bytes.Buffer", "<p>Buffer</p>", "")
+	failed := NewTask("https://pkg.go.dev/broken", "Go::broken", defaultModel)
+	failed.err = errors.New("download failed")
+	in := make(chan Task, 2)
+	in <- task
+	in <- failed
+	close(in)
+	var buf bytes.Buffer
+	summary := NotePrinter(context.Background(), DefaultConfig(), &buf, in)
+	// the implementation is printed only if present
+	want := "==================== Go::bytes (1/2) go:1.22\n" +
+		"-------------------- front\nfunc bytes.Clone\n" +
+		"-------------------- back\n<p>Clone</p>\n" +
+		"-------------------- implementation\n<pre>func Clone</pre>\n" +
+		"==================== Go::bytes (2/2) \n" +
+		"-------------------- front\ntype bytes.Buffer\n" +
+		"-------------------- back\n<p>Buffer</p>\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+	if want := (Summary{Decks: 2, Added: 2, Errors: 1, FailedUrls: []string{failed.url}, Failed: []UrlPair{failed.Pair()}}); !reflect.DeepEqual(summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+}
+
+func TestTsvWriter(t *testing.T) {
+	task := NewTask("https://pkg.go.dev/bytes", "Go::bytes", defaultModel)
+	task.AddNote("func bytes.Clone", "<pre>func Clone(b []byte) []byte {\r\n\treturn b\n}</pre>", "", "go:1.22", deprecatedTag)
+	task.AddNote("type bytes.Buffer", "<p>A Buffer</p>", "<pre>type Buffer struct{}</pre>")
+	failed := NewTask("https://pkg.go.dev/broken", "Go::broken", defaultModel)
+	failed.err = errors.New("download failed")
+	in := make(chan Task, 2)
+	in <- task
+	in <- failed
+	close(in)
+	var buf bytes.Buffer
+	summary := TsvWriter(context.Background(), DefaultConfig(), &buf, in)
+	want := "#separator:tab\n#html:true\n#deck column:1\n#tags column:5\n" +
+		"Go::bytes\tfunc bytes.Clone\t<pre>func Clone(b []byte) []byte {&#10;&#9;return b&#10;}</pre>\t\tgo:1.22 deprecated\n" +
+		"Go::bytes\ttype bytes.Buffer\t<p>A Buffer</p>\t<pre>type Buffer struct{}</pre>\t\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+	if want := (Summary{Decks: 2, Added: 2, Errors: 1, FailedUrls: []string{failed.url}, Failed: []UrlPair{failed.Pair()}}); !reflect.DeepEqual(summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+}
+
+func TestHtmlCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache, err := NewHtmlCache(dir, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const page = "https://pkg.go.dev/bytes"
+	if _, ok := cache.Get(page); ok {
+		t.Fatal("expected a miss on the empty cache")
+	}
+	if err := cache.Put(page, []byte("<html>bytes</html>")); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := cache.Get(page); !ok || string(got) != "<html>bytes</html>" {
+		t.Fatalf("expected a hit, got '%s' %v", got, ok)
+	}
+	if _, ok := cache.Get("https://pkg.go.dev/io"); ok {
+		t.Fatal("expected a miss for another url")
+	}
+
+	// -refresh ignores the entry, but stores new downloads
+	refreshed, err := NewHtmlCache(dir, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := refreshed.Get(page); ok {
+		t.Fatal("expected -refresh to miss")
+	}
+	if err := refreshed.Put(page, []byte("<html>new</html>")); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := cache.Get(page); !ok || string(got) != "<html>new</html>" {
+		t.Fatalf("expected the refreshed entry, got '%s' %v", got, ok)
+	}
+
+	// entries older than the ttl are stale, a zero ttl keeps them forever
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cache.path(page), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(page); ok {
+		t.Fatal("expected the expired entry to miss")
+	}
+	forever, err := NewHtmlCache(dir, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := forever.Get(page); !ok {
+		t.Fatal("expected a hit without ttl")
+	}
+
+	var none *HtmlCache
+	if err := none.Put(page, []byte("<html></html>")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := none.Get(page); ok {
+		t.Fatal("expected the nil cache to miss")
+	}
+}
+
+// a http.RoundTripper calling the function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// the field map of the Config passed to the stages names the fields of built and exported notes
+func TestConfigFieldMap(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FieldMap = FieldMap{Front: "Front", Back: "Back", Impl: "Extra"}
+	src, err := os.ReadFile(filepath.Join("testdata", "bytes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := NewTask("https://pkg.go.dev/bytes@go1.22.0", "Go::bytes", defaultModel)
+	task.html = src
+	in := make(chan Task, 1)
+	in <- task
+	close(in)
+	processed := make(chan Task, 1)
+	// sources linked by the page aren't fetched
+	HtmlProcessor(context.Background(), cfg, &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("offline")
+	})}, processed, in)
+	task = <-processed
+	if task.err != nil || len(task.notes) == 0 {
+		t.Fatalf("expected notes, got %v", task.err)
+	}
+	for _, note := range task.notes {
+		if _, ok := note.Fields["Front"]; !ok || note.Fields[defaultFieldMap.Front] != "" {
+			t.Fatalf("expected the fields of the field map, got %v", note.Fields)
+		}
+	}
+
+	out := make(chan Task, 1)
+	out <- task
+	close(out)
+	var buf bytes.Buffer
+	JsonWriter(context.Background(), cfg, &buf, out)
+	var notes []JsonNote
+	if err := json.Unmarshal(buf.Bytes(), &notes); err != nil || len(notes) != len(task.notes) || notes[0].Front == "" {
+		t.Fatalf("expected the notes to be exported by the field map, got %v %s", err, buf.String())
+	}
+}
+
+// opens the collection of the Anki package `fp`, which is closed at the end of the test.
+func openApkg(t *testing.T, fp string) *sql.DB {
+	archive, err := zip.OpenReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	src, err := archive.Open("collection.anki2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	collection := filepath.Join(t.TempDir(), "collection.anki2")
+	dst, err := os.Create(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestApkgWriter(t *testing.T) {
+	bytesTask := NewTask("https://pkg.go.dev/bytes", "Go::bytes", defaultModel)
+	bytesTask.AddNote("<pre><code>func bytes.Clone({{c1::b []byte}}) {{c3::[]byte}}</code></pre>", "clone", "", "go:1.22")
+	bytesTask.AddNote("<pre><code>func bytes.Clone({{c1::b []byte}}) {{c3::[]byte}}</code></pre>", "copy", "")
+	fsTask := NewTask("https://pkg.go.dev/io/fs", "Go::io::fs", defaultModel)
+	fsTask.AddNote("type fs.FS", "interface", "")
+	failed := NewTask("https://pkg.go.dev/broken", "Go::broken", defaultModel)
+	failed.err = errors.New("download failed")
+
+	cases := []struct{
+		mode string
+		notes int
+		ords []int
+		decks []string
+		summary Summary
+	}{
+		// notes sharing the front of bytes.Clone are distinct notes
+		{modeBasic, 3, []int{0, 0, 0}, []string{"Default", "Go::bytes", "Go::io::fs"}, Summary{Decks: 3, Added: 3}},
+		// a card per cloze number, the note of fs.FS has none
+		{modeCloze, 2, []int{0, 2, 0, 2}, []string{"Default", "Go::bytes"}, Summary{Decks: 3, Added: 2, Rejected: 1}},
+	}
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		cfg.Mode = c.mode
+		cfg.OutputFile = filepath.Join(t.TempDir(), "notes.apkg")
+		in := make(chan Task, 3)
+		in <- bytesTask
+		in <- fsTask
+		in <- failed
+		close(in)
+		summary := ApkgWriter(context.Background(), cfg, in)
+		c.summary.Errors, c.summary.FailedUrls, c.summary.Failed = 1, []string{failed.url}, []UrlPair{failed.Pair()}
+		if !reflect.DeepEqual(summary, c.summary) {
+			t.Fatalf("%s: expected summary %+v, got %+v", c.mode, c.summary, summary)
+		}
+
+		db := openApkg(t, cfg.OutputFile)
+		var notes, guids int
+		if err := db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT guid) FROM notes").Scan(&notes, &guids); err != nil {
+			t.Fatal(err)
+		}
+		if notes != c.notes || guids != c.notes {
+			t.Errorf("%s: expected %d notes with distinct guids, got %d notes with %d guids", c.mode, c.notes, notes, guids)
+		}
+		var tags string
+		if err := db.QueryRow("SELECT tags FROM notes ORDER BY id LIMIT 1").Scan(&tags); err != nil || tags != " go:1.22 " {
+			t.Errorf("%s: expected the tags of the first note, got '%s' %v", c.mode, tags, err)
+		}
+
+		rows, err := db.Query("SELECT ord, did FROM cards ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ords := make([]int, 0)
+		dids := make(map[int64]bool)
+		for rows.Next() {
+			var ord int
+			var did int64
+			if err := rows.Scan(&ord, &did); err != nil {
+				t.Fatal(err)
+			}
+			ords = append(ords, ord)
+			dids[did] = true
+		}
+		rows.Close()
+		if !slices.Equal(ords, c.ords) {
+			t.Errorf("%s: expected card ords %v, got %v", c.mode, c.ords, ords)
+		}
+
+		var decksJson string
+		if err := db.QueryRow("SELECT decks FROM col").Scan(&decksJson); err != nil {
+			t.Fatal(err)
+		}
+		var decks map[string]struct{ Id int64; Name string }
+		if err := json.Unmarshal([]byte(decksJson), &decks); err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, deck := range decks {
+			names = append(names, deck.Name)
+			if deck.Name != "Default" && !dids[deck.Id] {
+				t.Errorf("%s: expected cards in deck %s", c.mode, deck.Name)
+			}
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, c.decks) {
+			t.Errorf("%s: expected decks %v, got %v", c.mode, c.decks, names)
+		}
+	}
+}
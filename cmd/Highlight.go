@@ -0,0 +1,153 @@
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// inline styles of highlighted Go tokens, see -highlight
+const (
+	keywordStyle = "color: #d73a49;"
+	stringStyle = "color: #032f62;"
+	numberStyle = "color: #005cc5;"
+	predeclaredStyle = "color: #6f42c1;"
+	highlightCommentStyle = "color: #6a737d; font-style: italic;"
+)
+
+// predeclared identifiers of Go, highlighted like builtins
+var predeclared = map[string]bool{
+	"any": true, "bool": true, "byte": true, "comparable": true, "complex64": true, "complex128": true, "error": true,
+	"float32": true, "float64": true, "int": true, "int8": true, "int16": true, "int32": true, "int64": true, "rune": true,
+	"string": true, "uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+	"true": true, "false": true, "iota": true, "nil": true,
+	"append": true, "cap": true, "clear": true, "close": true, "complex": true, "copy": true, "delete": true, "imag": true,
+	"len": true, "make": true, "max": true, "min": true, "new": true, "panic": true, "print": true, "println": true, "real": true, "recover": true,
+}
+
+// a highlighted range of Go source
+type goToken struct {
+	start, end int // byte offsets within the source
+	style string
+}
+
+// returns the highlighted tokens of the Go source `code` in order. Other tokens, e.g. operators and plain identifiers, are left out.
+// `code` doesn't need to be a complete file, declarations and snippets are tokenized as well, invalid characters are skipped.
+func GoTokens(code string) []goToken {
+	src := []byte(code)
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, func(token.Position, string) {}, scanner.ScanComments)
+	tokens := make([]goToken, 0)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			return tokens
+		}
+		var style string
+		switch {
+		case tok.IsKeyword():
+			style = keywordStyle
+		case tok == token.STRING || tok == token.CHAR:
+			style = stringStyle
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			style = numberStyle
+		case tok == token.COMMENT:
+			style = highlightCommentStyle
+		case tok == token.IDENT && predeclared[lit]:
+			style = predeclaredStyle
+		default:
+			continue
+		}
+		start := file.Offset(pos)
+		end := start + len(lit)
+		switch {
+		case lit == "":
+			end = start + len(tok.String())
+		// comments are reported without carriage returns, so their end is searched in the source
+		case tok == token.COMMENT && strings.HasPrefix(lit, "//"):
+			end = len(code)
+			if i := strings.IndexByte(code[start:], '\n'); i >= 0 {
+				end = start + i
+			}
+		case tok == token.COMMENT:
+			end = len(code)
+			if i := strings.Index(code[start:], "*/"); i >= 0 {
+				end = start + i + 2
+			}
+		}
+		tokens = append(tokens, goToken{start, min(end, len(code)), style})
+	}
+}
+
+// returns the Go source `code` as escaped HTML with its tokens wrapped into inline styled spans, see GoTokens.
+func HighlightCode(code string) string {
+	var sb strings.Builder
+	last := 0
+	for _, tok := range GoTokens(code) {
+		sb.WriteString(html.EscapeString(code[last:tok.start]))
+		sb.WriteString(`<span style="` + tok.style + `">` + html.EscapeString(code[tok.start:tok.end]) + "</span>")
+		last = tok.end
+	}
+	sb.WriteString(html.EscapeString(code[last:]))
+	return sb.String()
+}
+
+// highlights the Go source of the <pre> element `pre` in place, see GoTokens. Tokens are highlighted by splitting the text nodes
+// of the element, so links on identifiers and other markup of pkg.go.dev are kept.
+func HighlightCodeNode(pre *html.Node) {
+	texts := make([]*html.Node, 0)
+	var sb strings.Builder
+	var rec func(node *html.Node)
+	rec = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			texts = append(texts, node)
+			sb.WriteString(node.Data)
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			rec(c)
+		}
+	}
+	rec(pre)
+	code := sb.String()
+	tokens := GoTokens(code)
+	offset := 0
+	for _, text := range texts {
+		start, end := offset, offset + len(text.Data)
+		offset = end
+		// tokens overlapping the text node
+		pos := start
+		for _, tok := range tokens {
+			if tok.end <= pos || tok.start >= end {
+				continue
+			}
+			if tok.start > pos {
+				text.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: code[pos:tok.start]}, text)
+			}
+			span := &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{{Key: "style", Val: tok.style}}}
+			span.AppendChild(&html.Node{Type: html.TextNode, Data: code[max(tok.start, pos):min(tok.end, end)]})
+			text.Parent.InsertBefore(span, text)
+			pos = min(tok.end, end)
+		}
+		if pos == start {
+			continue
+		}
+		if pos < end {
+			text.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: code[pos:end]}, text)
+		}
+		text.Parent.RemoveChild(text)
+	}
+}
+
+// returns the Go source `code` as an HTML code block like CodeBlock, highlighted if enabled by -highlight.
+func (s CardSettings) GoCodeBlock(code string) string {
+	if !s.Highlight {
+		return s.CodeBlock(code)
+	}
+	if !s.InlineStyle {
+		return "<pre><code>" + HighlightCode(code) + "</code></pre>"
+	}
+	return `<pre style="` + codeStyle + `"><code>` + HighlightCode(code) + "</code></pre>"
+}
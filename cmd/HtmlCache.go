@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// on-disk cache of downloaded HTML sources, keyed by url.
+// A nil *HtmlCache never hits and stores nothing.
+type HtmlCache struct {
+	dir string
+	ttl time.Duration // entries older than ttl are stale, zero means entries never go stale
+	refresh bool // ignore existing entries, but store new downloads
+}
+
+// creates the cache directory `dir` if necessary.
+func NewHtmlCache(dir string, ttl time.Duration, refresh bool) (*HtmlCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cache directory '%s': %w", dir, err)
+	}
+	return &HtmlCache{
+		dir: dir,
+		ttl: ttl,
+		refresh: refresh,
+	}, nil
+}
+
+func (c *HtmlCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]) + ".html")
+}
+
+// returns the cached HTML source of `url`, if a fresh entry exists.
+func (c *HtmlCache) Get(url string) ([]byte, bool) {
+	if c == nil || c.refresh {
+		return nil, false
+	}
+	fp := c.path(url)
+	info, err := os.Stat(fp)
+	if err != nil || (c.ttl > 0 && time.Since(info.ModTime()) > c.ttl) {
+		return nil, false
+	}
+	html, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, false
+	}
+	return html, true
+}
+
+// stores the HTML source of `url`. The entry is written to a temporary file first,
+// so concurrent readers never see partial entries.
+func (c *HtmlCache) Put(url string, html []byte) error {
+	if c == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(html); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(url))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"html"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// notes of local packages are extracted from their Go source by go/doc instead of from pkg.go.dev pages, see -source-dir.
+
+// returns the directories below `root`, `root` included, which hold a Go package, in lexical order.
+// Like the go command testdata, vendor and directories starting with `.` or `_` are skipped, so are internal packages if `exportedOnly` is set.
+func PackageDirs(root string, exportedOnly bool) ([]string, error) {
+	dirs := make([]string, 0)
+	err := filepath.WalkDir(root, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if dir != root && (name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || exportedOnly && name == "internal") {
+			return filepath.SkipDir
+		}
+		_, err = build.ImportDir(dir, 0)
+		var noGo *build.NoGoError
+		switch {
+		case err == nil:
+			dirs = append(dirs, dir)
+		case !errors.As(err, &noGo):
+			slog.Warn("skipped directory", "dir", dir, "err", err)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// matches the module directive of a go.mod file
+var moduleDirective = regexp.MustCompile(`(?m)^\s*module\s+"?([^"\s]+)"?`)
+
+// returns the import path of the package in `dir`: the path of the module of the closest go.mod file joined with `dir` below it.
+// Without go.mod the path of `dir` below `root` prefixed by the name of `root` is returned.
+func SourceImportPath(root, dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for mod := abs; ; mod = filepath.Dir(mod) {
+		src, err := os.ReadFile(filepath.Join(mod, "go.mod"))
+		if err == nil {
+			match := moduleDirective.FindSubmatch(src)
+			if match == nil {
+				return "", fmt.Errorf("no module directive in '%s'", filepath.Join(mod, "go.mod"))
+			}
+			rel, err := filepath.Rel(mod, abs)
+			if err != nil {
+				return "", err
+			}
+			return path.Join(string(match[1]), filepath.ToSlash(rel)), nil
+		}
+		if filepath.Dir(mod) == mod {
+			break
+		}
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, abs)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(filepath.Base(absRoot), filepath.ToSlash(rel)), nil
+}
+
+// creates a task for each package directory `dirs` below the directory `root`, see PackageDirs. The deck of a package holds the levels of its import path,
+// e.g. example.com::mod::pkg, and is moved below -deck-prefix. The tasks are sent like by TaskGenerator, see SendTasks.
+// `out` is closed once all tasks are sent or `ctx` is cancelled.
+func SourceGenerator(ctx context.Context, cfg Config, root string, dirs []string, checkpoint *Checkpoint, progress *Progress, out chan<-Task) {
+	defer close(out)
+	tasks := make([]Task, 0, len(dirs))
+	for _, dir := range dirs {
+		importPath, err := SourceImportPath(root, dir)
+		if err != nil {
+			slog.Error("skipped package", "dir", dir, "err", err)
+			continue
+		}
+		abs, _ := filepath.Abs(dir)
+		task := NewTask((&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), strings.ReplaceAll(importPath, "/", ankiDeckSep), cfg.Model)
+		task.importPath = importPath
+		task.settings = cfg.CardSettings
+		task.dir = dir
+		tasks = append(tasks, task)
+	}
+	slog.Info("found packages", "dir", root, "packages", len(tasks))
+	SendTasks(ctx, cfg, tasks, checkpoint, progress, out)
+}
+
+// extracts the notes of the local packages of the tasks from their Go source, see Task.ProcessSource.
+// Tasks failed by a previous stage are passed on unchanged.
+func SourceProcessor(ctx context.Context, cfg Config, out chan<- Task, in <-chan Task) {
+	for task := range in {
+		if ctx.Err() != nil {
+			return
+		}
+		if task.err == nil {
+			task.settings = cfg.CardSettings
+			if err := task.ProcessSource(); err != nil {
+				task.err = err
+			}
+		}
+		if !Send(ctx, out, task) {
+			return
+		}
+	}
+}
+
+// adds notes of the package in `t.dir` to the task like Process does for its page: for the package documentation,
+// each constant block, variable block, function, type and method. Fronts name the symbols like the headers of pkg.go.dev,
+// e.g. `func (*Buffer) bytes.Buffer.Len`, backs hold the declaration followed by its documentation, implementations the source of functions.
+// Examples, struct fields and reverse notes aren't generated, neither are notes with -added-since, as the source carries no versions.
+func (t *Task) ProcessSource() error {
+	s := t.settings
+	if s.AddedSince != nil {
+		return nil
+	}
+	bpkg, err := build.ImportDir(t.dir, 0)
+	if err != nil {
+		return fmt.Errorf("SourceProcessor::%w", err)
+	}
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0, len(bpkg.GoFiles))
+	// source of functions by position, as go/doc drops their bodies
+	impls := make(map[token.Pos]string)
+	for _, name := range bpkg.GoFiles {
+		src, err := os.ReadFile(filepath.Join(t.dir, name))
+		if err != nil {
+			return fmt.Errorf("SourceProcessor::%w", err)
+		}
+		file, err := parser.ParseFile(fset, filepath.Join(t.dir, name), src, parser.ParseComments)
+		if err != nil {
+			return fmt.Errorf("SourceProcessor::%w", err)
+		}
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				impls[fn.Pos()] = string(src[fset.Position(fn.Pos()).Offset:fset.Position(fn.End()).Offset])
+			}
+		}
+		files = append(files, file)
+	}
+	var mode doc.Mode
+	if !s.ExportedOnly {
+		mode = doc.AllDecls
+	}
+	pkg, err := doc.NewFromFiles(fset, files, t.ImportPath(), mode)
+	if err != nil {
+		return fmt.Errorf("SourceProcessor::%w", err)
+	}
+
+	src := func(node any) string {
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, node); err != nil {
+			slog.Warn("printing a declaration failed", "deck", t.deck, "err", err)
+		}
+		return buf.String()
+	}
+	// documentation rendered as HTML, doc links point to pkg.go.dev or -base-url
+	docs := func(text string) string {
+		if s.NoDoc || text == "" {
+			return ""
+		}
+		p := pkg.Printer()
+		p.DocLinkBaseURL = "https://pkg.go.dev"
+		if s.BaseUrl != nil {
+			p.DocLinkBaseURL = strings.TrimSuffix(s.BaseUrl.String(), "/")
+		}
+		return string(p.HTML(pkg.Parser().Parse(text)))
+	}
+
+	if pkg.Doc != "" && !s.NoDoc && s.Mode != modeCloze {
+		t.AddNote("package " + t.ImportPath(), docs(pkg.Doc), "")
+	}
+
+	values := func(values []*doc.Value, kind string, split bool) {
+		for _, value := range values {
+			tags := SourceDeprecationTags(value.Doc)
+			for _, spec := range value.Decl.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					name.Name = pkg.Name + "." + name.Name
+				}
+			}
+			if !split || len(value.Decl.Specs) < 2 {
+				block := s.GoCodeBlock(src(value.Decl)) + docs(value.Doc)
+				t.AddNote(block, block, "", tags...)
+				continue
+			}
+			for _, spec := range value.Decl.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					t.AddNote(html.EscapeString(name.Name), s.GoCodeBlock(kind + " " + src(spec)) + docs(value.Doc), "", tags...)
+				}
+			}
+		}
+	}
+	funcs := func(funcs []*doc.Func, receiver string) {
+		for _, fn := range funcs {
+			signature := src(fn.Decl)
+			front := html.EscapeString("func " + pkg.Name + "." + fn.Name)
+			if fn.Recv != "" {
+				front = html.EscapeString("func (" + src(fn.Decl.Recv.List[0].Type) + ") " + pkg.Name + "." + receiver + "." + fn.Name)
+			}
+			if s.Mode == modeCloze {
+				cloze, err := ClozeSignature(signature, pkg.Name)
+				if err != nil || cloze == "" {
+					continue
+				}
+				front = s.CodeBlock(cloze)
+			}
+			t.AddNote(front, s.GoCodeBlock(signature) + docs(fn.Doc), s.GoCodeBlock(impls[fn.Decl.Pos()]), SourceDeprecationTags(fn.Doc)...)
+		}
+	}
+
+	if s.Mode != modeCloze {
+		values(pkg.Consts, "const", s.SplitConstBlocks)
+		values(pkg.Vars, "var", s.SplitVarBlocks)
+	}
+	funcs(pkg.Funcs, "")
+	for _, typ := range pkg.Types {
+		if s.Mode != modeCloze {
+			values(typ.Consts, "const", s.SplitConstBlocks)
+			values(typ.Vars, "var", s.SplitVarBlocks)
+			t.AddNote(html.EscapeString("type " + pkg.Name + "." + typ.Name), s.GoCodeBlock(src(typ.Decl)) + docs(typ.Doc), "", SourceDeprecationTags(typ.Doc)...)
+		}
+		funcs(typ.Funcs, "")
+		funcs(typ.Methods, typ.Name)
+	}
+	slog.Info("generated notes", "deck", t.deck, "dir", t.dir, "consts", len(pkg.Consts), "vars", len(pkg.Vars), "funcs", len(pkg.Funcs), "types", len(pkg.Types), "notes", len(t.notes), "duplicates", t.duplicates)
+	return nil
+}
+
+// returns the `deprecated` tag, if a paragraph of the doc comment `text` starts with the "Deprecated:" marker.
+func SourceDeprecationTags(text string) []string {
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if deprecatedPattern.MatchString(paragraph) {
+			return []string{deprecatedTag}
+		}
+	}
+	return nil
+}
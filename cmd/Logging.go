@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// levels selectable by -log-level
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info": slog.LevelInfo,
+	"warn": slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// returns the level named `name`, one of debug, info, warn and error.
+func ParseLogLevel(name string) (slog.Level, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s', expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// returns a logger writing records of at least `level` to `w` as key=value pairs,
+// e.g. `level=INFO msg="downloaded documentation" url=https://pkg.go.dev/bytes bytes=1234`.
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
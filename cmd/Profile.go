@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/ericchiang/css"
+)
+
+// selectors locating the parts of a documentation page, which depend on the renderer of the page and its version.
+// Pages of another layout are supported by adding a profile to `profiles`.
+type Profile struct {
+	Overview *css.Selector // section holding the package documentation
+	Variables *css.Selector // declaration blocks of variables, followed by their documentation paragraphs
+	VariableIds *css.Selector // identifiers within a variable block, carrying their name as id
+	Constants *css.Selector // declaration blocks of constants, followed by their documentation paragraphs
+	ConstantIds *css.Selector // identifiers within a constant block, carrying their name as id
+	Functions *css.Selector // blocks of package level functions
+	FunctionHeaders *css.Selector // header within a function block, carrying the function name as id
+	Types *css.Selector // blocks of types, including their methods
+	TypeHeaders *css.Selector // header within a type block, carrying the type name as id
+	Methods *css.Selector // blocks of methods
+	MethodHeaders *css.Selector // header within a method block, carrying `<receiver>.<method>` as id
+	SourceLink *css.Selector // anchor within a header around the declared name, linking to the source code
+	HeaderLink *css.Selector // anchor within a header linking to the header itself (¶)
+	Declaration *css.Selector // <pre> element holding the declaration of a block
+	DeprecatedBadge *css.Selector // badge within the header of a deprecated declaration
+	SinceVersion *css.Selector // annotation within a header naming the Go version, which added the symbol
+	Examples *css.Selector // runnable examples, carrying `example-<symbol>[-<suffix>]` as id
+	ExampleTitle *css.Selector // title within an example
+	ExampleCode *css.Selector // code within an example
+	ExampleOutput *css.Selector // expected output within an example
+	NotFound *css.Selector // message of error pages, which are served instead of unknown packages
+	Directories *css.Selector // links to the packages below a module or directory page
+}
+
+const defaultProfile = "pkgdev-2024"
+
+// known profiles by name
+var profiles = map[string]*Profile{
+	// pkg.go.dev since 2021
+	defaultProfile: {
+		Overview: css.MustParse("section.Documentation-overview"),
+		Variables: css.MustParse("section.Documentation-variables div.Documentation-declaration"),
+		VariableIds: css.MustParse("span[data-kind='variable']"),
+		Constants: css.MustParse("section.Documentation-constants div.Documentation-declaration"),
+		ConstantIds: css.MustParse("span[data-kind='constant']"),
+		Functions: css.MustParse("div.Documentation-function"),
+		FunctionHeaders: css.MustParse("h4.Documentation-functionHeader"),
+		Types: css.MustParse("div.Documentation-type"),
+		TypeHeaders: css.MustParse("h4.Documentation-typeHeader"),
+		Methods: css.MustParse("div.Documentation-typeMethod"),
+		MethodHeaders: css.MustParse("h4.Documentation-typeMethodHeader"),
+		SourceLink: css.MustParse("a.Documentation-source"),
+		HeaderLink: css.MustParse("a.Documentation-idLink"),
+		Declaration: css.MustParse("div.Documentation-declaration pre"),
+		DeprecatedBadge: css.MustParse("span.Documentation-deprecatedTag"),
+		SinceVersion: css.MustParse("span.Documentation-sinceVersion"),
+		Examples: css.MustParse("details.Documentation-exampleDetails"),
+		ExampleTitle: css.MustParse("summary.Documentation-exampleDetailsHeader"),
+		ExampleCode: css.MustParse(".Documentation-exampleCode"),
+		ExampleOutput: css.MustParse("span.Documentation-exampleOutput"),
+		NotFound: css.MustParse(".Error-message"),
+		Directories: css.MustParse("table.UnitDirectories-table a[href]"),
+	},
+}
+
+// returns the names of the known profiles in alphabetical order.
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// stages of the pipeline counted by Progress
+const (
+	stageDownloaded = iota
+	stageProcessed
+	stageFinished // handed to the final stage, which takes the next task only after finishing the current one
+	stageCount
+)
+
+var stageNames = [stageCount]string{"downloaded", "processed", "finished"}
+
+// counts of the tasks, which passed the stages of the pipeline
+type Progress struct {
+	total atomic.Int64 // tasks created by TaskGenerator, negative until all are created
+	counts [stageCount]atomic.Int64
+}
+
+func NewProgress() *Progress {
+	p := &Progress{}
+	p.total.Store(-1)
+	return p
+}
+
+// records the number of tasks created by TaskGenerator. A nil *Progress records nothing.
+func (p *Progress) SetTotal(n int) {
+	if p == nil {
+		return
+	}
+	p.total.Store(int64(n))
+}
+
+// forwards the tasks of `in` to `out`, counting them as passed `stage`. 
+// Closes `out` once `in` is closed or `ctx` is cancelled. A nil *Progress forwards the tasks without counting them.
+func (p *Progress) Relay(ctx context.Context, stage int, out chan<- Task, in <-chan Task) {
+	defer close(out)
+	for task := range in {
+		if !Send(ctx, out, task) {
+			return
+		}
+		if p != nil {
+			p.counts[stage].Add(1)
+		}
+	}
+}
+
+// returns the counts of all stages, e.g. `12/40 downloaded, 10/40 processed, 8/40 finished`.
+// The total is shown as `?` until all tasks are created.
+func (p *Progress) String() string {
+	total := "?"
+	if n := p.total.Load(); n >= 0 {
+		total = fmt.Sprint(n)
+	}
+	s := ""
+	for stage := range p.counts {
+		if stage > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d/%s %s", p.counts[stage].Load(), total, stageNames[stage])
+	}
+	return s
+}
+
+// logs the progress every `interval` until `ctx` is cancelled.
+func (p *Progress) Log(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			slog.Info("progress", "tasks", p.String())
+		}
+	}
+}
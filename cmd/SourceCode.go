@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// downloads Go source files linked by `a.Documentation-source` anchors and extracts declarations from them.
+// Files are cached, since most declarations of a package live in a few files.
+// Not safe for concurrent use, create one instance per task. A nil *SourceFetcher fetches nothing.
+type SourceFetcher struct {
+	ctx context.Context
+	client *http.Client
+	userAgent string
+	files map[string][]byte
+}
+
+func NewSourceFetcher(ctx context.Context, client *http.Client, userAgent string) *SourceFetcher {
+	return &SourceFetcher{
+		ctx: ctx,
+		client: client,
+		userAgent: userAgent,
+		files: make(map[string][]byte),
+	}
+}
+
+// returns the source code of the declaration the source link `link` points to.
+// A nil *SourceFetcher downloads nothing and returns an empty declaration.
+func (s *SourceFetcher) Declaration(link string) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	raw, line, err := RawSourceUrl(link)
+	if err != nil {
+		return "", err
+	}
+	src, ok := s.files[raw]
+	if !ok {
+		src, err = s.download(raw)
+		if err != nil {
+			return "", err
+		}
+		s.files[raw] = src
+	}
+	return ExtractDeclaration(src, line)
+}
+
+func (s *SourceFetcher) download(raw string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	req.Header.Set("User-Agent", s.userAgent)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("SourceFetcher::download::'%s': %s", raw, resp.Status)
+	}
+	return ReadBody(resp)
+}
+
+// maps a source link of pkg.go.dev onto the url of the raw file and the linked line.
+// Supported are
+// - https://cs.opensource.google/go/<repo>/+/<ref>:<path>;l=<line> (standard library and golang.org/x/...)
+// - https://github.com/<owner>/<repo>/blob/<ref>/<path>#L<line>
+func RawSourceUrl(link string) (string, int, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", 0, err
+	}
+	switch u.Host {
+	case "cs.opensource.google":
+		repo, rest, ok := strings.Cut(strings.TrimPrefix(u.Path, "/go/"), "/+/")
+		if !ok {
+			break
+		}
+		ref, rest, ok := strings.Cut(rest, ":")
+		if !ok {
+			break
+		}
+		path, lineStr, ok := strings.Cut(rest, ";l=")
+		if !ok {
+			break
+		}
+		line, err := strconv.Atoi(lineStr)
+		if err != nil {
+			break
+		}
+		// go.googlesource.com/<repo> is mirrored to github.com/golang/<repo>
+		repo = strings.TrimPrefix(repo, "x/")
+		return fmt.Sprintf("https://raw.githubusercontent.com/golang/%s/%s/%s", repo, ref, path), line, nil
+	case "github.com":
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 5)
+		if len(parts) < 5 || parts[2] != "blob" {
+			break
+		}
+		line, err := strconv.Atoi(strings.TrimPrefix(u.Fragment, "L"))
+		if err != nil {
+			break
+		}
+		return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s", parts[0], parts[1], parts[3], parts[4]), line, nil
+	}
+	return "", 0, fmt.Errorf("unsupported source link '%s'", link)
+}
+
+// returns the source code of the top-level declaration in `src` containing `line`.
+// For grouped declarations only the spec containing `line` is returned.
+func ExtractDeclaration(src []byte, line int) (string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	text := func(from, to token.Pos) string {
+		return string(src[fset.Position(from).Offset:fset.Position(to).Offset])
+	}
+	contains := func(node ast.Node) bool {
+		return fset.Position(node.Pos()).Line <= line && line <= fset.Position(node.End()).Line
+	}
+	for _, decl := range file.Decls {
+		if !contains(decl) {
+			continue
+		}
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || !gen.Lparen.IsValid() {
+			return text(decl.Pos(), decl.End()), nil
+		}
+		for _, spec := range gen.Specs {
+			if contains(spec) {
+				return gen.Tok.String() + " " + text(spec.Pos(), spec.End()), nil
+			}
+		}
+		return text(decl.Pos(), decl.End()), nil
+	}
+	return "", errors.New("no declaration found at line " + strconv.Itoa(line))
+}
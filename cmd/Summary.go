@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// outcome of a run, accumulated by the final stage of the pipeline
+type Summary struct {
+	Decks int // tasks received, one per (deck, url) pair
+	Added int // notes uploaded or written
+	Duplicates int // notes skipped, as they already exist
+	Rejected int // notes Anki refused
+	Empty int // tasks skipped, as they produced no notes
+	Errors int // tasks which carried an error and failures of the stage itself
+	FailedUrls []string // urls of the tasks which carried an error
+	Failed []UrlPair // pairs of the tasks which carried an error, see Task.Pair
+}
+
+// counts `task` as failed.
+func (s *Summary) Fail(task Task) {
+	s.Errors++
+	s.FailedUrls = append(s.FailedUrls, task.url)
+	s.Failed = append(s.Failed, task.Pair())
+}
+
+// writes the summary as a table to `w`, followed by the urls of failed tasks.
+func (s Summary) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "decks\tadded\tduplicates\trejected\tempty\terrors\t\n")
+	fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\t\n", s.Decks, s.Added, s.Duplicates, s.Rejected, s.Empty, s.Errors)
+	tw.Flush()
+	for _, url := range s.FailedUrls {
+		fmt.Fprintf(w, "failed: %s\n", url)
+	}
+}
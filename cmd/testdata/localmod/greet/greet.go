@@ -0,0 +1,44 @@
+// Package greet greets people, see [strings.Title] for capitalizing names.
+package greet
+
+import "strings"
+
+// Greetings of the supported languages.
+const (
+	English = "Hello"
+	German = "Hallo"
+)
+
+// Default is the greeting used by Hello.
+var Default = English
+
+// Hello returns the greeting of `name` in the default language.
+func Hello(name string) string {
+	return Default + ", " + strings.TrimSpace(name) + "!"
+}
+
+// Hi returns an informal greeting.
+//
+// Deprecated: Use Hello instead.
+func Hi(name string) string {
+	return "Hi " + name
+}
+
+// Greeter greets people in its language.
+type Greeter struct {
+	Greeting string
+	count int
+}
+
+// NewGreeter returns a greeter using `greeting`.
+func NewGreeter(greeting string) *Greeter {
+	return &Greeter{Greeting: greeting}
+}
+
+// Greet returns the greeting of `name`.
+func (g *Greeter) Greet(name string) string {
+	g.count++
+	return g.Greeting + ", " + name + "!"
+}
+
+func helper() {}
@@ -0,0 +1,5 @@
+// Package secret is internal to the module.
+package secret
+
+// Value is secret.
+const Value = 42
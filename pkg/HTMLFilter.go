@@ -1,7 +1,9 @@
+// Package HTMLTrees copies, filters, searches and rewrites trees of golang.org/x/net/html nodes.
+// Failures are reported by returned errors, no function of this package logs fatally or exits the program.
 package HTMLTrees
 
 import (
-	"log"
+	"net/url"
 	"strings"
 
 	"github.com/ericchiang/css"
@@ -9,18 +11,48 @@ import (
 )
 
 
-// render node to HTML string
-func HTMLString(node *html.Node) string {
+// render node to HTML string, fails for trees html.Render refuses, e.g. void elements with children. nil renders as the empty string.
+func HTMLString(node *html.Node) (string, error) {
+	if node == nil {
+		return "", nil
+	}
 	var sb strings.Builder
 	if err := html.Render(&sb, node); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	return sb.String()
+	return sb.String(), nil
 }
 
 
-// Flat copy of an *html.Node, all pointers are set to nil
+// returns the text of `node`'s subtree. Text nodes are concatenated in document order,
+// runs of whitespace are collapsed into single spaces and the result is trimmed.
+// Contents of <script> and <style> elements are skipped.
+func TextContent(node *html.Node) string {
+	if node == nil {
+		return ""
+	}
+	var sb strings.Builder
+	var rec func(node *html.Node)
+	rec = func(node *html.Node) {
+		switch {
+		case node.Type == html.TextNode:
+			sb.WriteString(node.Data)
+		case node.Type == html.ElementNode && (node.Data == "script" || node.Data == "style"):
+		default:
+			for c := node.FirstChild; c != nil; c = c.NextSibling {
+				rec(c)
+			}
+		}
+	}
+	rec(node)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// Flat copy of an *html.Node, all pointers are set to nil. Copy of nil is nil.
 func Copy(node *html.Node) *html.Node {
+	if node == nil {
+		return nil
+	}
 	var attr []html.Attribute 
 	if len(node.Attr) > 0 {
 		attr = make([]html.Attribute, len(node.Attr))
@@ -31,6 +63,7 @@ func Copy(node *html.Node) *html.Node {
 	return &html.Node{
 		DataAtom: node.DataAtom,
 		Data: node.Data,
+		Namespace: node.Namespace,
 		Attr: attr,
 		Parent: nil,
 		NextSibling: nil,
@@ -63,18 +96,24 @@ func rec(root *html.Node, cpy *html.Node, sel func (*html.Node) bool) {
 	cpy.LastChild = prev
 }
 
-// returns a deep copy of `root`'s html tree
+// returns an independent deep copy of `root`'s html tree, which shares no nodes and no attribute slices with the original,
+// so either of them can be modified without affecting the other. The copy has no parent and no siblings.
 func DeepCopy(root *html.Node) *html.Node {
-	newRoot := Copy(root)
-	sel := func(node *html.Node) bool {
-		return true 
-	}
-	rec(root, newRoot, sel)
-	return newRoot
+	return DeepCopyFunc(root, func(node *html.Node) bool {
+		return true
+	})
+}
+
+// same as DeepCopy
+func Clone(node *html.Node) *html.Node {
+	return DeepCopy(node)
 }
 
 // returns a deep copy of root containing only nodes fullfilling `sel`
 func DeepCopyFunc(root *html.Node, sel func(*html.Node) bool) *html.Node {
+	if root == nil {
+		return nil
+	}
 	newRoot := Copy(root)
 	rec(root, newRoot, sel)
 	return newRoot
@@ -85,7 +124,24 @@ func DeepCopyFunc(root *html.Node, sel func(*html.Node) bool) *html.Node {
 // - it is not matched by `selector`
 // - and none node from its subtree is matched by `selector`. 
 func DeepCopySelector(root *html.Node, selector *css.Selector) (*html.Node) {
+	return deepCopyNodes(root, selector.Select(root))
+}
+
+// returns a deep copy of the `root` tree like DeepCopySelector, 
+// but only the first `n` nodes matched by `selector` in document order are considered matched.
+func DeepCopySelectorN(root *html.Node, selector *css.Selector, n int) (*html.Node) {
 	nodes := selector.Select(root)
+	if n < 0 {
+		n = 0
+	}
+	if n < len(nodes) {
+		nodes = nodes[:n]
+	}
+	return deepCopyNodes(root, nodes)
+}
+
+// returns a deep copy of the `root` tree containing `nodes` and their ancestors.
+func deepCopyNodes(root *html.Node, nodes []*html.Node) (*html.Node) {
 	cache := make(map[*html.Node]bool, len(nodes))
 	for _, node := range nodes {
 		cache[node] = true
@@ -153,12 +209,15 @@ func DeepCopySubtrees(root *html.Node, subtrees []*html.Node) (*html.Node) {
 
 }
 
-// Run f on all nodes in the given tree.
+// Run f on all nodes in the given tree in document order.
+// The walk stops at the first error returned by f, which is returned.
 func Modify(node *html.Node, f func(*html.Node) error) error {
 	if node == nil {
 		return nil
 	}
-	f(node)
+	if err := f(node); err != nil {
+		return err
+	}
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
 		err := Modify(c, f)
 		if err != nil {
@@ -167,3 +226,209 @@ func Modify(node *html.Node, f func(*html.Node) error) error {
 	}
 	return nil
 }
+
+// Run f on all nodes in the given tree in document order, passing the depth of each node below `node`, which has depth 0.
+// The walk stops at the first error returned by f, which is returned.
+func WalkWithDepth(node *html.Node, f func(n *html.Node, depth int) error) error {
+	return walkWithDepth(node, 0, f)
+}
+
+func walkWithDepth(node *html.Node, depth int, f func(*html.Node, int) error) error {
+	if node == nil {
+		return nil
+	}
+	if err := f(node, depth); err != nil {
+		return err
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if err := walkWithDepth(c, depth + 1, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run f on the nodes of the given tree in document order, until f returns `stop` or an error.
+// Nodes following the stopping node are not visited.
+func ModifyUntil(node *html.Node, f func(*html.Node) (stop bool, err error)) error {
+	_, err := modifyUntil(node, f)
+	return err
+}
+
+func modifyUntil(node *html.Node, f func(*html.Node) (bool, error)) (bool, error) {
+	if node == nil {
+		return false, nil
+	}
+	if stop, err := f(node); stop || err != nil {
+		return true, err
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if stop, err := modifyUntil(c, f); stop || err != nil {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// resolves the `href` attributes of all nodes in the given tree against `base`, turning local links into global ones.
+// Stops at the first href, which can't be parsed.
+func ResolveHrefs(root *html.Node, base *url.URL) error {
+	return Modify(root, func(node *html.Node) error {
+		for i := 0; i < len(node.Attr); i++ {
+			if node.Attr[i].Key == "href" {
+				link, err := url.Parse(node.Attr[i].Val)
+				if err != nil {
+					return err
+				}
+				node.Attr[i].Val = base.ResolveReference(link).String()
+			}
+		}
+		return nil
+	})
+}
+
+// detaches `node` from its parent, linking its former siblings to each other.
+// Nodes without a parent are left as they are.
+func RemoveNode(node *html.Node) {
+	parent := node.Parent
+	if parent == nil {
+		return
+	}
+	if node.PrevSibling != nil {
+		node.PrevSibling.NextSibling = node.NextSibling
+	} else {
+		parent.FirstChild = node.NextSibling
+	}
+	if node.NextSibling != nil {
+		node.NextSibling.PrevSibling = node.PrevSibling
+	} else {
+		parent.LastChild = node.PrevSibling
+	}
+	node.Parent = nil
+	node.PrevSibling = nil
+	node.NextSibling = nil
+}
+
+// puts `new` in the place of `old` within its parent's children and detaches `old`.
+// `new` is detached from its own parent first. Nodes without a parent are left as they are.
+func ReplaceNode(old, new *html.Node) {
+	parent := old.Parent
+	if parent == nil || old == new {
+		return
+	}
+	RemoveNode(new)
+	parent.InsertBefore(new, old)
+	RemoveNode(old)
+}
+
+// moves the children of `node` into its position and detaches `node`.
+// Nodes without a parent are left as they are.
+func Unwrap(node *html.Node) {
+	parent := node.Parent
+	if parent == nil {
+		return
+	}
+	for c := node.FirstChild; c != nil; {
+		next := c.NextSibling
+		RemoveNode(c)
+		parent.InsertBefore(c, node)
+		c = next
+	}
+	RemoveNode(node)
+}
+
+// merges consecutive text nodes of the given tree into the first of them, e.g. those left behind by RemoveNode and Unwrap,
+// so text spanning them is matched as a whole. Text nodes separated by an element or comment are kept apart.
+func NormalizeText(root *html.Node) {
+	if root == nil {
+		return
+	}
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.TextNode {
+			NormalizeText(c)
+			continue
+		}
+		for c.NextSibling != nil && c.NextSibling.Type == html.TextNode {
+			next := c.NextSibling
+			c.Data += next.Data
+			RemoveNode(next)
+		}
+	}
+}
+
+// elements rendered as blocks, whitespace between them doesn't render
+var blockElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "meta": true, "link": true, "script": true, "style": true,
+	"div": true, "section": true, "article": true, "main": true, "header": true, "footer": true, "nav": true, "aside": true,
+	"p": true, "pre": true, "blockquote": true, "hr": true, "details": true, "summary": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true, "th": true, "td": true,
+}
+
+// reports whether `node` is nil or a block element.
+func isBlock(node *html.Node) bool {
+	return node == nil || node.Type == html.ElementNode && blockElements[node.Data] || node.Type == html.CommentNode
+}
+
+// removes the text nodes of the given tree, which consist of whitespace only and sit between block elements.
+// Whitespace inside <pre> and <textarea> and between inline elements is kept, as it renders.
+func TrimWhitespaceNodes(root *html.Node) {
+	blank := make([]*html.Node, 0)
+	var rec func(node *html.Node)
+	rec = func(node *html.Node) {
+		if node.Type == html.ElementNode && (node.Data == "pre" || node.Data == "textarea") {
+			return
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				if strings.TrimSpace(c.Data) == "" && isBlock(c.PrevSibling) && isBlock(c.NextSibling) {
+					blank = append(blank, c)
+				}
+				continue
+			}
+			rec(c)
+		}
+	}
+	rec(root)
+	for _, node := range blank {
+		RemoveNode(node)
+	}
+}
+
+// elements which only structure the page and are dropped by StripAttributes once they carry no attributes
+var structuralElements = map[string]bool{
+	"div": true,
+	"section": true,
+	"article": true,
+	"main": true,
+}
+
+// removes all attributes except `keep` from the nodes of the given tree.
+// Structural elements like <div> left without attributes are unwrapped, their children take their place.
+func StripAttributes(node *html.Node, keep ...string) {
+	wrappers := make([]*html.Node, 0)
+	WalkWithDepth(node, func(n *html.Node, depth int) error {
+		if n.Type != html.ElementNode {
+			return nil
+		}
+		attr := n.Attr[:0]
+		for _, a := range n.Attr {
+			for _, k := range keep {
+				if a.Key == k {
+					attr = append(attr, a)
+					break
+				}
+			}
+		}
+		n.Attr = attr
+		if len(attr) == 0 && structuralElements[n.Data] && depth > 0 {
+			wrappers = append(wrappers, n)
+		}
+		return nil
+	})
+	for _, wrapper := range wrappers {
+		Unwrap(wrapper)
+	}
+}
+
@@ -1,7 +1,10 @@
 package HTMLTrees
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
 	"slices"
 	"strings"
 	"testing"
@@ -66,6 +69,40 @@ func compareTrees(a, b *html.Node) error {
 	return nil
 }
 
+// renders `node`, failing the test if it can't be rendered
+func render(t *testing.T, node *html.Node) string {
+	t.Helper()
+	s, err := HTMLString(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHTMLString(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(`<p>Hello <b>World</b></p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := FindFirst(root, css.MustParse("p"))
+	if got := render(t, p); got != "<p>Hello <b>World</b></p>" {
+		t.Fatalf("unexpected HTML %s", got)
+	}
+
+	// void elements can't have children
+	br := &html.Node{Type: html.ElementNode, Data: "br"}
+	br.AppendChild(&html.Node{Type: html.TextNode, Data: "text"})
+	if _, err := HTMLString(br); err == nil {
+		t.Fatal("expected an error for a void element with children")
+	}
+	// errors of subtrees are returned as well
+	div := &html.Node{Type: html.ElementNode, Data: "div"}
+	div.AppendChild(&html.Node{Type: html.ErrorNode, Data: "broken"})
+	if got, err := HTMLString(div); err == nil || got != "" {
+		t.Fatalf("expected an error for an error node, got %#v", got)
+	}
+}
+
 func TestDeepCopy(t *testing.T) {
 	root, err := html.Parse(strings.NewReader(htmlSrc))
 	if err != nil {
@@ -131,8 +168,8 @@ func TestDeepCopySelector(t *testing.T) {
 		t.Fatal(err)
 	}
 	/*
-	fmt.Printf("Got: \n%v\n", HTMLString(rootCpy))
-	fmt.Printf("Expected: \n%v\n", HTMLString(expectedRoot))
+	fmt.Printf("Got: \n%v\n", render(t, rootCpy))
+	fmt.Printf("Expected: \n%v\n", render(t, expectedRoot))
 	*/
 	if err := compareTrees(rootCpy, expectedRoot); err != nil {
 		t.Fatal(err)
@@ -147,6 +184,38 @@ func TestDeepCopySelector(t *testing.T) {
 	}
 }
 
+func TestDeepCopySelectorN(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(RemoveNewlinesAndTabs(htmlSrc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := css.MustParse("div > div > p")
+	cases := []struct{
+		n int
+		want []string
+	}{
+		{-1, []string{}},
+		{0, []string{}},
+		{2, []string{"Hello", "World"}},
+		{3, []string{"Hello", "World", "!"}},
+		{10, []string{"Hello", "World", "!"}},
+	}
+	for _, c := range cases {
+		cpy := DeepCopySelectorN(root, selector, c.n)
+		got := make([]string, 0)
+		for _, p := range css.MustParse("p").Select(cpy) {
+			got = append(got, TextContent(p))
+		}
+		if !slices.Equal(got, c.want) {
+			t.Fatalf("n = %d: expected paragraphs %v, got %v", c.n, c.want, got)
+		}
+		// pruned subtrees leave no empty ancestors behind
+		if divs := len(css.MustParse("body > div").Select(cpy)); divs != len(c.want) {
+			t.Fatalf("n = %d: expected %d divs, got %d", c.n, len(c.want), divs)
+		}
+	}
+}
+
 func TestDeepCopySubtree(t *testing.T) {
 	root, err := html.Parse(strings.NewReader(RemoveNewlinesAndTabs(htmlSrc))) 
 	if err != nil { 
@@ -166,8 +235,8 @@ func TestDeepCopySubtree(t *testing.T) {
 	}
 
 	if err := compareTrees(rootCpy, expectedTree); err != nil {
-		fmt.Println("Got:\n", HTMLString(rootCpy))
-		fmt.Println("Expected:\n", HTMLString(expectedTree))
+		fmt.Println("Got:\n", render(t, rootCpy))
+		fmt.Println("Expected:\n", render(t, expectedTree))
 		t.Fatal(err)
 	}
 
@@ -179,3 +248,516 @@ func TestDeepCopySubtree(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestTextContent(t *testing.T) {
+	src := `<html><head><style>p { color: red; }</style></head><body>
+		<div>
+			<p>Hello <b>bold</b>
+				World</p>
+			<p>mixed<i>text</i>and <span>ele<em>me</em>nts</span> </p>
+			<script>var x = "hidden";</script>
+		</div>
+	</body></html>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Hello bold World mixedtextand elements"
+	if got := TextContent(root); got != expected {
+		t.Fatalf("%#v != %#v\n", got, expected)
+	}
+
+	selector, err := css.Parse("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paragraphs := selector.Select(root)
+	if got := TextContent(paragraphs[0]); got != "Hello bold World" {
+		t.Fatalf("%#v != %#v\n", got, "Hello bold World")
+	}
+
+	empty := &html.Node{Type: html.ElementNode, Data: "div"}
+	if got := TextContent(empty); got != "" {
+		t.Fatalf("expected empty string, got %#v\n", got)
+	}
+}
+
+func TestModifyStopsOnError(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(RemoveNewlinesAndTabs(htmlSrc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := errors.New("stop")
+	visited := make([]string, 0)
+	err = Modify(root, func(node *html.Node) error {
+		if node.Type != html.ElementNode {
+			return nil
+		}
+		visited = append(visited, node.Data)
+		if len(node.Attr) > 0 && node.Attr[0].Val == "zwei" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("expected %v, got %v\n", stop, err)
+	}
+	expected := []string{"html", "head", "body", "div", "div", "p", "div", "div"}
+	if !slices.Equal(visited, expected) {
+		t.Fatalf("%v != %v\n", visited, expected)
+	}
+}
+
+func TestModifyUntil(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(RemoveNewlinesAndTabs(htmlSrc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rename the first <p>, the following ones have to stay untouched
+	err = ModifyUntil(root, func(node *html.Node) (bool, error) {
+		if node.Type == html.ElementNode && node.Data == "p" {
+			node.Data = "span"
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector, err := css.Parse("span, p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, node := range selector.Select(root) {
+		got = append(got, node.Data)
+	}
+	expected := []string{"span", "p", "p"}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("%v != %v\n", got, expected)
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err = ModifyUntil(root, func(node *html.Node) (bool, error) {
+		visited++
+		return false, stop
+	})
+	if err != stop || visited != 1 {
+		t.Fatalf("expected to stop at the root with %v, got %v after %d nodes\n", stop, err, visited)
+	}
+}
+
+func TestWalkWithDepth(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(RemoveNewlinesAndTabs(htmlSrc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := FindFirst(root, css.MustParse("body"))
+	got := make([]string, 0)
+	err = WalkWithDepth(body, func(node *html.Node, depth int) error {
+		switch node.Type {
+		case html.ElementNode:
+			got = append(got, fmt.Sprintf("%s:%d", node.Data, depth))
+		case html.TextNode:
+			got = append(got, fmt.Sprintf("%q:%d", node.Data, depth))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"body:0",
+		"div:1", "div:2", "p:3", `"Hello":4`,
+		"div:1", "div:2", "p:3", `"World":4`,
+		"div:1", "div:2", "p:3", `"!":4`,
+	}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("%v != %v\n", got, expected)
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err = WalkWithDepth(body, func(node *html.Node, depth int) error {
+		visited++
+		if depth == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || visited != 3 {
+		t.Fatalf("expected to stop at the first node of depth 2 with %v, got %v after %d nodes\n", stop, err, visited)
+	}
+}
+
+func TestResolveHrefs(t *testing.T) {
+	src := `<html><body>
+		<a class="Documentation-source" href="/bytes#Buffer" data-href="#keep">Buffer</a>
+		<a href="#Compare" id="x" class="y">Compare</a>
+		<link rel="stylesheet" type="text/css" href="static/style.css">
+	</body></html>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := url.Parse("https://pkg.go.dev/bytes@go1.22.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveHrefs(root, base); err != nil {
+		t.Fatal(err)
+	}
+	selector, err := css.Parse("a, link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, node := range selector.Select(root) {
+		for _, attr := range node.Attr {
+			if strings.HasSuffix(attr.Key, "href") {
+				got = append(got, attr.Key + "=" + attr.Val)
+			}
+		}
+	}
+	expected := []string{
+		"href=https://pkg.go.dev/bytes#Buffer",
+		"data-href=#keep",
+		"href=https://pkg.go.dev/bytes@go1.22.0#Compare",
+		"href=https://pkg.go.dev/static/style.css",
+	}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("%v != %v\n", got, expected)
+	}
+
+	broken := &html.Node{Type: html.ElementNode, Data: "a", Attr: []html.Attribute{{Key: "href", Val: "%zz"}}}
+	if err := ResolveHrefs(broken, base); err == nil {
+		t.Fatal("expected an error for an unparsable href")
+	}
+}
+
+func TestStripAttributes(t *testing.T) {
+	src := `<div class="a" id="x"><section class="b"><p class="c" id="y">text <a class="d" href="/link">link</a></p></section><div data-x="1">rest</div></div>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := root.FirstChild.LastChild
+	StripAttributes(body, "href", "id")
+	got := render(t, body)
+	want := `<body><div id="x"><p id="y">text <a href="/link">link</a></p>rest</div></body>`
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+// returns the data of `parent`'s children, checking the sibling and parent links on the way.
+func childData(t *testing.T, parent *html.Node) []string {
+	res := make([]string, 0)
+	var prev *html.Node
+	for c := parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Parent != parent || c.PrevSibling != prev {
+			t.Fatalf("inconsistent links at '%s'", c.Data)
+		}
+		res = append(res, c.Data)
+		prev = c
+	}
+	if parent.LastChild != prev {
+		t.Fatal("LastChild isn't the last child")
+	}
+	return res
+}
+
+func TestRemoveNode(t *testing.T) {
+	cases := []struct{
+		remove int
+		want []string
+	}{
+		{0, []string{"b", "i"}},
+		{1, []string{"a", "i"}},
+		{2, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		root, err := html.Parse(strings.NewReader(`<a></a><b></b><i></i>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := root.FirstChild.LastChild
+		node := body.FirstChild
+		for i := 0; i < c.remove; i++ {
+			node = node.NextSibling
+		}
+		RemoveNode(node)
+		if got := childData(t, body); !slices.Equal(got, c.want) {
+			t.Fatalf("removing child %d: expected %v, got %v", c.remove, c.want, got)
+		}
+		if node.Parent != nil || node.PrevSibling != nil || node.NextSibling != nil {
+			t.Fatalf("removing child %d: node is still linked", c.remove)
+		}
+	}
+
+	// nodes without a parent are left alone
+	RemoveNode(&html.Node{Type: html.ElementNode, Data: "p"})
+}
+
+func TestReplaceNode(t *testing.T) {
+	cases := []struct{
+		replace int
+		want []string
+	}{
+		{0, []string{"p", "b", "i"}},
+		{1, []string{"a", "p", "i"}},
+		{2, []string{"a", "b", "p"}},
+	}
+	for _, c := range cases {
+		root, err := html.Parse(strings.NewReader(`<a></a><b></b><i></i>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := root.FirstChild.LastChild
+		old := body.FirstChild
+		for i := 0; i < c.replace; i++ {
+			old = old.NextSibling
+		}
+		new := &html.Node{Type: html.ElementNode, Data: "p"}
+		ReplaceNode(old, new)
+		if got := childData(t, body); !slices.Equal(got, c.want) {
+			t.Fatalf("replacing child %d: expected %v, got %v", c.replace, c.want, got)
+		}
+		if old.Parent != nil || old.PrevSibling != nil || old.NextSibling != nil {
+			t.Fatalf("replacing child %d: old node is still linked", c.replace)
+		}
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	cases := []struct{
+		src string
+		want []string
+	}{
+		{`<div><a></a><b></b></div><i></i>`, []string{"a", "b", "i"}},
+		{`<a></a><div><b></b></div><i></i>`, []string{"a", "b", "i"}},
+		{`<a></a><b></b><div><i></i></div>`, []string{"a", "b", "i"}},
+		{`<a></a><div></div><i></i>`, []string{"a", "i"}},
+	}
+	for _, c := range cases {
+		root, err := html.Parse(strings.NewReader(c.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := root.FirstChild.LastChild
+		var div *html.Node
+		for n := body.FirstChild; n != nil; n = n.NextSibling {
+			if n.Data == "div" {
+				div = n
+			}
+		}
+		Unwrap(div)
+		if got := childData(t, body); !slices.Equal(got, c.want) {
+			t.Fatalf("unwrapping %s: expected %v, got %v", c.src, c.want, got)
+		}
+		if div.Parent != nil || div.FirstChild != nil || div.LastChild != nil {
+			t.Fatalf("unwrapping %s: div is still linked", c.src)
+		}
+	}
+}
+
+func TestTrimWhitespaceNodes(t *testing.T) {
+	cases := []struct{
+		src string
+		want string
+	}{
+		{
+			"<div>\n\t<h4>Header</h4>\n\t<p>text</p>\n\t\n<p>more</p>\n</div>",
+			"<div><h4>Header</h4><p>text</p><p>more</p></div>",
+		},
+		{
+			"<p><a>inline</a> <b>kept</b>\n</p>",
+			"<p><a>inline</a> <b>kept</b>\n</p>",
+		},
+		{
+			"<div>\n<pre>\n  code\n\n<span>x</span> <span>y</span>\n</pre>\n</div>",
+			"<div><pre>  code\n\n<span>x</span> <span>y</span>\n</pre></div>",
+		},
+		{
+			"<section>\n<!-- comment -->\n<div> text </div>\n</section>",
+			"<section><!-- comment --><div> text </div></section>",
+		},
+	}
+	for _, c := range cases {
+		root, err := html.Parse(strings.NewReader(c.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := root.FirstChild.LastChild
+		TrimWhitespaceNodes(body)
+		got := ""
+		for n := body.FirstChild; n != nil; n = n.NextSibling {
+			got += render(t, n)
+		}
+		if got != c.want {
+			t.Fatalf("expected %q, got %q", c.want, got)
+		}
+	}
+}
+
+func TestDeepCopyKeepsNamespace(t *testing.T) {
+	src := `<div><svg viewBox="0 0 10 10"><circle r="5"></circle></svg><math><mi>x</mi></math></div>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	div := root.FirstChild.LastChild.FirstChild
+	copies := map[string]*html.Node{
+		"DeepCopy": DeepCopy(root),
+		"DeepCopySubtrees": DeepCopySubtrees(root, []*html.Node{div.FirstChild, div.LastChild}),
+	}
+	for name, cpy := range copies {
+		namespaces := make(map[string]string)
+		Modify(cpy, func(node *html.Node) error {
+			if node.Type == html.ElementNode {
+				namespaces[node.Data] = node.Namespace
+			}
+			return nil
+		})
+		want := map[string]string{"svg": "svg", "circle": "svg", "math": "math", "mi": "math", "div": ""}
+		for data, ns := range want {
+			if namespaces[data] != ns {
+				t.Fatalf("%s: expected namespace '%s' of <%s>, got '%s'", name, ns, data, namespaces[data])
+			}
+		}
+		if got := render(t, cpy); !strings.Contains(got, `<svg viewBox="0 0 10 10"><circle r="5"></circle></svg>`) {
+			t.Fatalf("%s: unexpected rendering %s", name, got)
+		}
+	}
+}
+
+func TestNilTrees(t *testing.T) {
+	if Copy(nil) != nil || DeepCopy(nil) != nil || DeepCopyFunc(nil, func(*html.Node) bool { return true }) != nil {
+		t.Fatal("expected copies of nil to be nil")
+	}
+	if got, err := HTMLString(nil); got != "" || err != nil {
+		t.Fatalf("expected nil to render as the empty string, got %#v %v", got, err)
+	}
+	if got := TextContent(nil); got != "" {
+		t.Fatalf("expected no text, got %#v", got)
+	}
+	if FindAll(nil, css.MustParse("p")) != nil || FindFirst(nil, css.MustParse("p")) != nil {
+		t.Fatal("expected no matches in a nil tree")
+	}
+	if MatchingNodes(nil, regexp.MustCompile("x")) != nil || SelectByText(nil, regexp.MustCompile("x")) != nil {
+		t.Fatal("expected no matches in a nil tree")
+	}
+	if err := Modify(nil, func(*html.Node) error { return errors.New("visited") }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// copies of DeepCopy and its alias Clone share no pointers with the original
+func TestDeepCopyIndependent(t *testing.T) {
+	for name, deepCopy := range map[string]func(*html.Node) *html.Node{"DeepCopy": DeepCopy, "Clone": Clone} {
+		root, err := html.Parse(strings.NewReader(htmlSrc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := FindFirst(root, css.MustParse("body"))
+		cpy := deepCopy(body)
+		if err := compareTrees(body, cpy); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if cpy.Parent != nil || cpy.PrevSibling != nil || cpy.NextSibling != nil {
+			t.Fatalf("%s: expected the copy to be detached", name)
+		}
+
+		// no node or attribute slice is shared
+		nodes := make(map[*html.Node]bool)
+		attrs := make(map[*html.Attribute]bool)
+		Modify(body, func(n *html.Node) error {
+			nodes[n] = true
+			if len(n.Attr) > 0 {
+				attrs[&n.Attr[0]] = true
+			}
+			return nil
+		})
+		Modify(cpy, func(n *html.Node) error {
+			if nodes[n] || len(n.Attr) > 0 && attrs[&n.Attr[0]] {
+				t.Fatalf("%s: copy shares %v with the original", name, n)
+			}
+			for _, linked := range []*html.Node{n.Parent, n.FirstChild, n.LastChild, n.PrevSibling, n.NextSibling} {
+				if nodes[linked] {
+					t.Fatalf("%s: copy links to %v of the original", name, linked)
+				}
+			}
+			return nil
+		})
+
+		// changes of either tree don't affect the other
+		before := render(t, body)
+		div := FindFirst(cpy, css.MustParse(".eins"))
+		div.Attr[0].Val = "changed"
+		div.FirstChild.Data = "changed"
+		RemoveNode(FindFirst(cpy, css.MustParse(".zwei")))
+		if after := render(t, body); after != before {
+			t.Fatalf("%s: changing the copy changed the original:\n%s", name, after)
+		}
+		before = render(t, cpy)
+		FindFirst(body, css.MustParse(".drei p")).FirstChild.Data = "?"
+		RemoveNode(FindFirst(body, css.MustParse(".eins")))
+		if after := render(t, cpy); after != before {
+			t.Fatalf("%s: changing the original changed the copy:\n%s", name, after)
+		}
+		if deepCopy(nil) != nil {
+			t.Fatalf("%s: expected the copy of nil to be nil", name)
+		}
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	cases := []struct{
+		src string
+		unwrap string // element unwrapped before normalizing
+		texts []string // text children of the <p> afterwards
+	}{
+		{"<p>a<b>x</b>c</p>", "b", []string{"axc"}},
+		{"<p>a<i>i</i>b<b>x</b>c</p>", "b", []string{"a", "bxc"}},
+		{"<p>a<i>i</i>b<!-- comment -->c</p>", "", []string{"a", "b", "c"}},
+		{"<p><b>x</b><b>y</b></p>", "b", []string{"xy"}},
+	}
+	for _, c := range cases {
+		root, err := html.Parse(strings.NewReader(c.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.unwrap != "" {
+			for _, node := range FindAll(root, css.MustParse(c.unwrap)) {
+				Unwrap(node)
+			}
+		}
+		NormalizeText(root)
+		p := FindFirst(root, css.MustParse("p"))
+		var texts []string
+		for n := p.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type == html.TextNode {
+				texts = append(texts, n.Data)
+			}
+		}
+		if !slices.Equal(texts, c.texts) {
+			t.Errorf("%s: expected the text nodes %q, got %q", c.src, c.texts, texts)
+		}
+	}
+
+	// text matching spans the merged nodes
+	root, err := html.Parse(strings.NewReader("<p>Hello <b>World</b></p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Unwrap(FindFirst(root, css.MustParse("b")))
+	if nodes := MatchingNodes(root, regexp.MustCompile("Hello World")); len(nodes) != 0 {
+		t.Fatalf("expected no match before normalizing, got %d", len(nodes))
+	}
+	NormalizeText(root)
+	if nodes := MatchingNodes(root, regexp.MustCompile("Hello World")); len(nodes) != 1 {
+		t.Fatalf("expected a match after normalizing, got %d", len(nodes))
+	}
+	NormalizeText(nil)
+}
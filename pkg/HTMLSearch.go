@@ -1,25 +1,33 @@
 package HTMLTrees
 
 import (
-	"log"
 	"regexp"
+	"slices"
+	"strings"
 
+	"github.com/ericchiang/css"
 	"golang.org/x/net/html"
 )
 
-// returns first textnode  from `root`'s subtree matching `regex` or nil if no textnode is found.
+// returns the text nodes of `root`'s subtree, whose text contains a match of `regex`, in document order.
+// A text node is returned as a whole, even if `regex` matches only a part of its text,
+// callers rewrite the matches with `regex.ReplaceAllString(node.Data, ...)`, which may refer to capture groups of `regex`.
+// Text is matched node by node, so matches spanning several text nodes, e.g. `<b>Hello</b> World`, aren't found.
+// Contents of elements are searched recursively, other nodes like comments are skipped. Returns nil if no text node matches.
 func MatchingNodes(root *html.Node, regex *regexp.Regexp) []*html.Node {
+	if root == nil {
+		return nil
+	}
 	switch root.Type {
 	case html.TextNode:
 		match := regex.MatchString(root.Data)
-		//log.Printf("Pattern : %#v ; %#v ; %v\n", regex.String(), root.Data, match)
 		if match {
 			return []*html.Node{root}
 		}
 		return nil
 
-	case html.ElementNode: 
-		res := make([]*html.Node, 0)
+	case html.ElementNode, html.DocumentNode: 
+		var res []*html.Node
 		for c := root.FirstChild; c != nil; c = c.NextSibling {
 			t := MatchingNodes(c, regex)
 			if t != nil {
@@ -28,9 +36,75 @@ func MatchingNodes(root *html.Node, regex *regexp.Regexp) []*html.Node {
 
 		}
 		return res
-	default:
-		log.Fatal(root.Type)
 	}
 	return nil
 }
 
+// returns the element nodes of `root`'s subtree, `root` included, whose text matches `regex`, in document order.
+// The text of an element is the concatenation of its descendant text nodes as is, i.e. including newlines,
+// so unlike MatchingNodes matches may span several text nodes, e.g. `<p>Hello <b>World</b></p>` matches `Hello World`.
+// Ancestors of a matching element match as well, unless `regex` is anchored like `^Deprecated:`.
+func SelectByText(root *html.Node, regex *regexp.Regexp) []*html.Node {
+	if root == nil {
+		return nil
+	}
+	var res []*html.Node
+	var rec func(node *html.Node) string
+	rec = func(node *html.Node) string {
+		if node.Type == html.TextNode {
+			return node.Data
+		}
+		var sb strings.Builder
+		i := len(res)
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			sb.WriteString(rec(c))
+		}
+		if node.Type == html.ElementNode && regex.MatchString(sb.String()) {
+			// ancestors precede their descendants in document order
+			res = slices.Insert(res, i, node)
+		}
+		return sb.String()
+	}
+	rec(root)
+	return res
+}
+
+// returns all nodes from `root`'s subtree matched by `sel` in document order.
+func FindAll(root *html.Node, sel *css.Selector) []*html.Node {
+	if root == nil {
+		return nil
+	}
+	return sel.Select(root)
+}
+
+// returns the first node from `root`'s subtree matched by `sel` or nil if no node matches.
+func FindFirst(root *html.Node, sel *css.Selector) *html.Node {
+	nodes := FindAll(root, sel)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// returns the number of nodes from `root`'s subtree, `root` included, fullfilling `pred`.
+func CountFunc(root *html.Node, pred func(*html.Node) bool) int {
+	count := 0
+	Modify(root, func(node *html.Node) error {
+		if pred(node) {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// returns the nearest node fullfilling `pred` among `node` and its ancestors, walking up the parent links, or nil if none does.
+// E.g. the declaration block of a span is `ClosestFunc(span, func(n *html.Node) bool { return n.Data == "div" })`.
+func ClosestFunc(node *html.Node, pred func(*html.Node) bool) *html.Node {
+	for ; node != nil; node = node.Parent {
+		if pred(node) {
+			return node
+		}
+	}
+	return nil
+}
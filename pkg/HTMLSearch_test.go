@@ -3,9 +3,11 @@ package HTMLTrees
 import (
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/ericchiang/css"
 	"golang.org/x/net/html"
 )
 
@@ -29,3 +31,173 @@ func TestMatchingNodes(t *testing.T) {
 	fmt.Printf("%+v\n", node)
 }
 
+func TestMatchingNodesCases(t *testing.T) {
+	tests := []struct {
+		name string
+		src string
+		pattern string
+		texts []string // data of the matched text nodes
+	}{
+		{"full match", `<p>World</p>`, `^World$`, []string{"World"}},
+		{"partial match", `<p>Hello World</p>`, `World`, []string{"Hello World"}},
+		{"nested matches", `<div>Go<p>Go <b>Go</b></p><!-- Go --></div>`, `Go`, []string{"Go", "Go ", "Go"}},
+		{"match across nodes", `<p>Hello <b>World</b></p>`, `Hello World`, nil},
+		{"no match", `<p>Hello</p><p>World</p>`, `Golang`, nil},
+	}
+	for _, test := range tests {
+		root, err := html.Parse(strings.NewReader(test.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, node := range MatchingNodes(root, regexp.MustCompile(test.pattern)) {
+			if node.Type != html.TextNode {
+				t.Fatalf("%s: matched a non text node %v", test.name, node)
+			}
+			texts = append(texts, node.Data)
+		}
+		if !slices.Equal(texts, test.texts) {
+			t.Fatalf("%s: expected %q, got %q", test.name, test.texts, texts)
+		}
+	}
+}
+
+// the identifier prefixing of the cmd package rewrites the matched nodes by a named capture group
+func TestMatchingNodesCaptureGroup(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(`<pre>const <span id="MaxRune">MaxRune</span> = '\U0010FFFF'</pre>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern := regexp.MustCompile(`(?P<id>MaxRune)`)
+	nodes := MatchingNodes(root, pattern)
+	if len(nodes) != 1 {
+		t.Fatalf("expected 1 node, got %d", len(nodes))
+	}
+	nodes[0].Data = pattern.ReplaceAllString(nodes[0].Data, "utf8.${id}")
+	if text := TextContent(root); text != `const utf8.MaxRune = '\U0010FFFF'` {
+		t.Fatalf("unexpected text '%s'", text)
+	}
+}
+
+func TestSelectByText(t *testing.T) {
+	src := `<div id="doc"><p id="summary">Title returns a copy.</p>` +
+		`<p id="deprecated">Deprecated: The rule Title uses
+for word boundaries does <b id="not">not</b> handle Unicode punctuation.</p></div>`
+	tests := []struct {
+		name string
+		pattern string
+		ids []string // ids of the selected elements
+	}{
+		{"nested elements", `Unicode`, []string{"doc", "deprecated"}},
+		{"element of its own text", `^not$`, []string{"not"}},
+		{"multi-line text", `(?s)^Deprecated:.*punctuation\.$`, []string{"deprecated"}},
+		{"line anchors", `(?m)^for word boundaries`, []string{"doc", "deprecated"}},
+		{"text across nodes", `does not handle`, []string{"doc", "deprecated"}},
+		{"no match", `Golang`, nil},
+	}
+	for _, test := range tests {
+		root, err := html.Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, node := range SelectByText(root, regexp.MustCompile(test.pattern)) {
+			if len(node.Attr) == 0 {
+				continue // <html> and <body>
+			}
+			ids = append(ids, node.Attr[0].Val)
+		}
+		if !slices.Equal(ids, test.ids) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.ids, ids)
+		}
+	}
+}
+
+func TestFindFirstAndFindAll(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(htmlSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		selector string
+		count int
+		first string
+	}{
+		{"span", 0, ""},
+		{".zwei", 1, "zwei"},
+		{"body > div > div", 3, "eins"},
+	}
+	for _, test := range tests {
+		sel, err := css.Parse(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodes := FindAll(root, sel); len(nodes) != test.count {
+			t.Fatalf("'%s': expected %d nodes, got %d\n", test.selector, test.count, len(nodes))
+		}
+		first := FindFirst(root, sel)
+		if test.count == 0 {
+			if first != nil {
+				t.Fatalf("'%s': expected nil, got %v\n", test.selector, first)
+			}
+			continue
+		}
+		if first == nil || len(first.Attr) == 0 || first.Attr[0].Val != test.first {
+			t.Fatalf("'%s': expected first node with class '%s', got %v\n", test.selector, test.first, first)
+		}
+	}
+}
+
+func TestCountFunc(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(htmlSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		pred func(*html.Node) bool
+		count int
+	}{
+		{"elements", func(n *html.Node) bool { return n.Type == html.ElementNode }, 12},
+		{"none", func(*html.Node) bool { return false }, 0},
+		{"paragraphs", func(n *html.Node) bool { return n.Type == html.ElementNode && n.Data == "p" }, 3},
+		{"divs", func(n *html.Node) bool { return n.Type == html.ElementNode && n.Data == "div" }, 6},
+		{"root", func(n *html.Node) bool { return n == root }, 1},
+	}
+	for _, test := range tests {
+		if got := CountFunc(root, test.pred); got != test.count {
+			t.Errorf("%s: expected %d nodes, got %d\n", test.name, test.count, got)
+		}
+	}
+	if got := CountFunc(nil, func(*html.Node) bool { return true }); got != 0 {
+		t.Fatalf("expected no nodes in a nil tree, got %d\n", got)
+	}
+}
+
+func TestClosestFunc(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(htmlSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := FindFirst(root, css.MustParse("div.zwei p"))
+	text := p.FirstChild
+	isDiv := func(n *html.Node) bool { return n.Type == html.ElementNode && n.Data == "div" }
+	tests := []struct {
+		name string
+		node *html.Node
+		pred func(*html.Node) bool
+		want *html.Node
+	}{
+		{"self", p, func(n *html.Node) bool { return n.Data == "p" }, p},
+		{"parent", text, isDiv, p.Parent},
+		{"grandparent", p, func(n *html.Node) bool { return isDiv(n) && len(n.Attr) == 0 }, p.Parent.Parent},
+		{"document", text, func(n *html.Node) bool { return n.Type == html.DocumentNode }, root},
+		{"none", text, func(n *html.Node) bool { return n.Data == "span" }, nil},
+		{"nil", nil, isDiv, nil},
+	}
+	for _, test := range tests {
+		if got := ClosestFunc(test.node, test.pred); got != test.want {
+			t.Errorf("%s: expected %v, got %v\n", test.name, test.want, got)
+		}
+	}
+}